@@ -0,0 +1,86 @@
+package logic
+
+import "time"
+
+// Tx 批量变更。放置检查要看到之前各步的结果，因此地块归属仍随每步更新；
+// 只有相邻关系、联盟连通性、有效性和顶点推迟到提交时，对受影响的旗子和联盟各重算一次
+type Tx struct {
+	m  *Map
+	op *operation
+}
+
+func (tx *Tx) AddFlag(x int32, y int32, allianceId int32, typeId int32, tm time.Time) (*Flag, error) {
+	f, err := tx.m.newFlag(tx.op, x, y, allianceId, typeId, tm)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.m.insertStep(tx.op, f)
+	return f, nil
+}
+
+func (tx *Tx) RemoveFlag(flag *Flag) error {
+	if !tx.m.hasFlag(flag) {
+		return ErrNotOnMap
+	}
+
+	tx.m.removeStep(tx.op, flag)
+	return nil
+}
+
+// MoveFlag 把旗子移到新的地块，保留ID，放置时间改为当前时间，与在新地块上重新放置一致；
+// 不能放置时旗子留在原处、放置时间不变，并返回*PlacementError
+func (tx *Tx) MoveFlag(flag *Flag, x int32, y int32) error {
+	m := tx.m
+	if !m.hasFlag(flag) {
+		return ErrNotOnMap
+	}
+
+	m.removeStep(tx.op, flag)
+
+	err := m.CanPlaceFlag(x, y, flag.AllianceId, flag.Type.ID)
+	if err == nil {
+		tx.op.setFlagTile(flag, &Tile{
+			Vector2: Vector2{
+				x,
+				y,
+			},
+			ownerFlag: flag,
+		})
+		tx.op.setMTime(flag, m.clock())
+	}
+
+	m.insertStep(tx.op, flag)
+	return err
+}
+
+// Batch 在一次变更中执行fn里的所有操作，只在最后重算一次，记录撤销日志时整体作为一步可撤销的变更；
+// fn返回错误或panic时回滚所有操作，不发出任何事件，panic会继续向上传递。事件总是缓存到提交时才派发
+func (m *Map) Batch(fn func(tx *Tx) error) (*ChangeSet, error) {
+	op := m.newOperation()
+	op.buffered = true
+	op.rollback = []undoFunc{}
+	if err := m.runTx(op, fn); err != nil {
+		return nil, err
+	}
+
+	op.finish()
+	return op.changes, nil
+}
+
+// runTx 执行fn，没有正常返回nil时回滚其中已执行的操作
+func (m *Map) runTx(op *operation, fn func(tx *Tx) error) (err error) {
+	returned := false
+	defer func() {
+		if !returned || err != nil {
+			undo := m.newOperation()
+			undo.journal = false
+			undo.silent = true
+			op.rollbackAll(undo)
+		}
+	}()
+
+	err = fn(&Tx{m, op})
+	returned = true
+	return err
+}
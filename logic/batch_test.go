@@ -0,0 +1,204 @@
+package logic
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// batchOps 在tx中随机增删移动旗子
+func batchOps(rnd *rand.Rand, tx *Tx, flags []*Flag, steps int) []*Flag {
+	for i := 0; i < steps; i++ {
+		switch {
+		case len(flags) > 0 && rnd.Intn(4) == 0:
+			j := rnd.Intn(len(flags))
+			if tx.RemoveFlag(flags[j]) == nil {
+				flags = append(flags[:j], flags[j+1:]...)
+			}
+		case len(flags) > 0 && rnd.Intn(4) == 0:
+			tx.MoveFlag(flags[rnd.Intn(len(flags))], rnd.Int31n(40), rnd.Int31n(40))
+		default:
+			typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+			tm := time.Unix(int64(rnd.Intn(50)), 0)
+			if f, err := tx.AddFlag(rnd.Int31n(40), rnd.Int31n(40), rnd.Int31n(3)+1, typeId, tm); err == nil {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+func TestBatchMatchesRebuild(t *testing.T) {
+	for seed := int64(0); seed < 30; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, flags := randomMap(rnd, ResolveEarliest, 8)
+		before := ownership(m)
+
+		var events int
+		m.AddListener(ListenerFunc(func(e *Event) {
+			events++
+		}))
+
+		cs, err := m.Batch(func(tx *Tx) error {
+			batchOps(rnd, tx, flags, 12)
+			if events != 0 {
+				t.Fatalf("seed %d: %d events dispatched before commit", seed, events)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		assertSameAsReference(t, m, referenceMap(m, nil), "after batch")
+
+		after := ownership(m)
+		changed := 0
+		for pos, id := range after {
+			if before[pos] != id {
+				changed++
+			}
+		}
+		for pos := range before {
+			if _, ok := after[pos]; !ok {
+				changed++
+			}
+		}
+		if changed != len(cs.Tiles) {
+			t.Fatalf("seed %d: change set has %d tiles, map changed %d", seed, len(cs.Tiles), changed)
+		}
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	errAbort := errors.New("abort")
+	for seed := int64(0); seed < 30; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, flags := randomMap(rnd, ResolveNearest, 10)
+		ref := referenceMap(m, nil)
+		lastFlagId := m.lastFlagId
+
+		var events int
+		m.AddListener(ListenerFunc(func(e *Event) {
+			events++
+		}))
+
+		cs, err := m.Batch(func(tx *Tx) error {
+			batchOps(rnd, tx, append([]*Flag(nil), flags...), 12)
+			return errAbort
+		})
+		if err != errAbort || cs != nil {
+			t.Fatalf("seed %d: Batch = %v, %v", seed, cs, err)
+		}
+		if events != 0 {
+			t.Fatalf("seed %d: rolled back batch dispatched %d events", seed, events)
+		}
+		if m.lastFlagId != lastFlagId || len(m.FlagSpecs()) != len(flags) {
+			t.Fatalf("seed %d: %d flags after rollback, want %d", seed, len(m.FlagSpecs()), len(flags))
+		}
+		assertSameAsReference(t, m, ref, "after rollback")
+	}
+}
+
+// fn中途panic时同样回滚，panic继续传给调用者
+func TestBatchPanicRollsBack(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, flags := randomMap(rnd, ResolveNearest, 10)
+		before := dumpState(m)
+		steps := len(m.steps)
+
+		func() {
+			defer func() {
+				if r := recover(); r != "abort" {
+					t.Fatalf("seed %d: recovered %v", seed, r)
+				}
+			}()
+			m.Batch(func(tx *Tx) error {
+				batchOps(rnd, tx, append([]*Flag(nil), flags...), 12)
+				panic("abort")
+			})
+		}()
+
+		if got := dumpState(m); got != before {
+			t.Fatalf("seed %d: after panic:\n%s\nwant:\n%s", seed, got, before)
+		}
+		if len(m.steps) != steps {
+			t.Fatalf("seed %d: panicked batch left an undo step", seed)
+		}
+		if violations := m.Validate(); len(violations) > 0 {
+			t.Fatalf("seed %d: %v", seed, violations[0])
+		}
+	}
+}
+
+// 移动相当于在新地块重新放置，放置时间取当前时间；撤销后恢复原来的地块和时间
+func TestBatchMoveFlagRenewsMTime(t *testing.T) {
+	m := NewMap()
+	m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	f, _, _ := m.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0))
+	g, _, err := m.AddFlag(30, 0, 2, FlagTypeFortress, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := dumpState(m)
+
+	if _, err := m.Batch(func(tx *Tx) error {
+		return tx.MoveFlag(f, 16, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.MTime.Equal(time.Unix(1000, 0)) || !m.lastMTime.Equal(f.MTime) {
+		t.Fatalf("moved flag MTime %v, lastMTime %v", f.MTime, m.lastMTime)
+	}
+	// 移动后的旗子晚于g，两者之间的地块归g
+	if owner := m.ownerAt(23, 0); owner != g {
+		t.Fatalf("23:0 owned by %v, want the earlier flag %d", owner, g.ID)
+	}
+	assertSameAsReference(t, m, referenceMap(m, nil), "after move")
+
+	// 不能放置时时间不变
+	mtime := f.MTime
+	if _, err := m.Batch(func(tx *Tx) error {
+		return tx.MoveFlag(f, 30, 0)
+	}); err == nil || !f.MTime.Equal(mtime) {
+		t.Fatalf("failed move: %v, MTime %v", err, f.MTime)
+	}
+
+	m.Undo()
+	if got := dumpState(m); got != before || !f.MTime.Equal(time.Unix(0, 0)) {
+		t.Fatalf("after undo:\n%s\nwant:\n%s", got, before)
+	}
+}
+
+// 不记录撤销日志时批量变更仍能回滚，且不会写入撤销日志
+func TestBatchWithoutJournal(t *testing.T) {
+	errAbort := errors.New("abort")
+	for seed := int64(0); seed < 10; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, flags := randomMap(rnd, ResolveEarliest, 8)
+		m.SetJournalLimit(0)
+		before := dumpState(m)
+
+		if _, err := m.Batch(func(tx *Tx) error {
+			batchOps(rnd, tx, append([]*Flag(nil), flags...), 12)
+			return errAbort
+		}); err != errAbort {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if got := dumpState(m); got != before {
+			t.Fatalf("seed %d: after rollback:\n%s\nwant:\n%s", seed, got, before)
+		}
+
+		if _, err := m.Batch(func(tx *Tx) error {
+			batchOps(rnd, tx, flags, 12)
+			return nil
+		}); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if len(m.journal) != 0 || m.Undo() != nil {
+			t.Fatalf("seed %d: batch wrote %d journal entries with the journal off", seed, len(m.journal))
+		}
+		assertSameAsReference(t, m, referenceMap(m, nil), "after batch")
+	}
+}
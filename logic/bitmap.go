@@ -0,0 +1,69 @@
+package logic
+
+import "math/bits"
+
+// Bitmap 以旗子为中心、边长为2*radius+1的正方形位图，按行优先存储
+type Bitmap struct {
+	radius int32
+	side   int32
+	words  []uint64
+}
+
+func NewBitmap(radius int32) *Bitmap {
+	side := radius*2 + 1
+	return &Bitmap{
+		radius: radius,
+		side:   side,
+		words:  make([]uint64, (side*side+63)/64),
+	}
+}
+
+func (b *Bitmap) Radius() int32 {
+	return b.radius
+}
+
+// Contains 判断相对中心的偏移(dx, dy)是否落在位图范围内
+func (b *Bitmap) Contains(dx int32, dy int32) bool {
+	return dx >= -b.radius && dx <= b.radius && dy >= -b.radius && dy <= b.radius
+}
+
+func (b *Bitmap) index(dx int32, dy int32) int32 {
+	return (dy+b.radius)*b.side + dx + b.radius
+}
+
+func (b *Bitmap) Set(dx int32, dy int32) {
+	i := b.index(dx, dy)
+	b.words[i>>6] |= 1 << uint(i&63)
+}
+
+func (b *Bitmap) Clear(dx int32, dy int32) {
+	i := b.index(dx, dy)
+	b.words[i>>6] &^= 1 << uint(i&63)
+}
+
+func (b *Bitmap) Test(dx int32, dy int32) bool {
+	if !b.Contains(dx, dy) {
+		return false
+	}
+	i := b.index(dx, dy)
+	return b.words[i>>6]&(1<<uint(i&63)) != 0
+}
+
+func (b *Bitmap) Count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Each 按行优先顺序遍历所有置位的偏移
+func (b *Bitmap) Each(fn func(dx int32, dy int32)) {
+	for wi, w := range b.words {
+		for w != 0 {
+			i := int32(wi<<6 + bits.TrailingZeros64(w))
+			w &= w - 1
+			fn(i%b.side-b.radius, i/b.side-b.radius)
+		}
+	}
+}
@@ -10,7 +10,7 @@ import (
 type BoundarySeeker struct {
 	xBaseYTree   map[int32]*rbt.Tree // {x => y => &code}
 	yBaseXTree   map[int32]*rbt.Tree // {y => x => &code}
-	mp           *Map
+	invalid      map[Vector2]bool    //失效旗子的顶点，构造后不再读取地图
 	head         *Vertex
 	current      *Vertex
 	pCurrentCode *int
@@ -19,8 +19,9 @@ type BoundarySeeker struct {
 func NewBoundarySeeker(m *Map, allianceId int32) *BoundarySeeker {
 	xBaseYTree := make(map[int32]*rbt.Tree)
 	yBaseXTree := make(map[int32]*rbt.Tree)
+	invalid := make(map[Vector2]bool)
 
-	flags := m.flags[allianceId]
+	flags := m.allianceFlags(allianceId)
 
 	for f := range flags {
 		flagVertexes := f.Vertexes
@@ -44,6 +45,10 @@ func NewBoundarySeeker(m *Map, allianceId int32) *BoundarySeeker {
 				}
 
 				xTree.Put(int(x), refCode)
+
+				if !f.IsValid {
+					invalid[Vector2{x, y}] = true
+				}
 			}
 		}
 	}
@@ -51,7 +56,7 @@ func NewBoundarySeeker(m *Map, allianceId int32) *BoundarySeeker {
 	return &BoundarySeeker{
 		xBaseYTree: xBaseYTree,
 		yBaseXTree: yBaseXTree,
-		mp:         m,
+		invalid:    invalid,
 	}
 }
 
@@ -114,12 +119,7 @@ func (bs *BoundarySeeker) Next() (next *Vertex, err error) {
 }
 
 func (bs *BoundarySeeker) IsValid() bool {
-	tile, _ := bs.mp.GetTile(bs.head.X, bs.head.Y, false)
-	if tile != nil {
-		return tile.IsValid()
-	}
-
-	return false
+	return !bs.invalid[Vector2{bs.head.X, bs.head.Y}]
 }
 
 func (bs *BoundarySeeker) IsHead() bool {
@@ -0,0 +1,94 @@
+package logic
+
+import "sort"
+
+// TileChange 一个地块在一次变更前后的归属，ID为0表示无主
+type TileChange struct {
+	Vector2
+	FromFlag     int32
+	FromAlliance int32
+	ToFlag       int32
+	ToAlliance   int32
+}
+
+// ChangeSet 一次变更的净结果：中间过程中变了又变回来的不计入
+type ChangeSet struct {
+	Tiles     []TileChange //归属发生变化的地块
+	Validity  []*Flag      //IsValid发生变化的旗子，不含已移除的旗子
+	Alliances []int32      //领地或有效性变化、边界需要重绘的联盟
+}
+
+func (cs *ChangeSet) IsEmpty() bool {
+	return len(cs.Tiles) == 0 && len(cs.Validity) == 0 && len(cs.Alliances) == 0
+}
+
+// rememberOwner 记录地块在本次变更前的归属，只记第一次
+func (op *operation) rememberOwner(x int32, y int32, owner *Flag) {
+	pos := Vector2{x, y}
+	if _, ok := op.origins[pos]; !ok {
+		op.origins[pos] = owner
+	}
+}
+
+// rememberValid 记录旗子在本次变更前的有效性，只记第一次
+func (op *operation) rememberValid(flag *Flag) {
+	if _, ok := op.validity[flag]; !ok {
+		op.validity[flag] = flag.IsValid
+	}
+}
+
+func (op *operation) changeSet() *ChangeSet {
+	m := op.m
+	cs := &ChangeSet{}
+	alliances := make(map[int32]int32)
+
+	for pos, from := range op.origins {
+		to := m.ownerAt(pos.X, pos.Y)
+		if to == from {
+			continue
+		}
+
+		change := TileChange{Vector2: pos}
+		if from != nil {
+			change.FromFlag = from.ID
+			change.FromAlliance = from.AllianceId
+		}
+		if to != nil {
+			change.ToFlag = to.ID
+			change.ToAlliance = to.AllianceId
+		}
+		cs.Tiles = append(cs.Tiles, change)
+
+		if change.FromAlliance != change.ToAlliance {
+			alliances[change.FromAlliance] = change.FromAlliance
+			alliances[change.ToAlliance] = change.ToAlliance
+		}
+	}
+	delete(alliances, 0)
+
+	flipped := make(map[*Flag]*Flag)
+	for flag, valid := range op.validity {
+		if m.hasFlag(flag) && flag.IsValid != valid {
+			flipped[flag] = flag
+			alliances[flag.AllianceId] = flag.AllianceId
+		}
+	}
+	cs.Validity = sortFlags(flipped)
+
+	for allianceId := range alliances {
+		cs.Alliances = append(cs.Alliances, allianceId)
+	}
+	sort.Slice(cs.Alliances, func(i, j int) bool {
+		return cs.Alliances[i] < cs.Alliances[j]
+	})
+
+	sort.Slice(cs.Tiles, func(i, j int) bool {
+		a, b := cs.Tiles[i], cs.Tiles[j]
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+
+	return cs
+}
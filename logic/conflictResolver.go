@@ -0,0 +1,161 @@
+package logic
+
+// ConflictResolver 决定重叠地块的归属，放置和移除旗子时都由它裁决
+type ConflictResolver interface {
+	// Compare a比b更应该拥有tile时返回负数，b更应该时返回正数，不分先后返回0
+	Compare(tile *Tile, a *Flag, b *Flag) int
+}
+
+type ConflictResolverFunc func(tile *Tile, a *Flag, b *Flag) int
+
+func (fn ConflictResolverFunc) Compare(tile *Tile, a *Flag, b *Flag) int {
+	return fn(tile, a, b)
+}
+
+// 内置策略使用可比较的类型，以便Map识别先到先得的策略
+type presetResolver struct {
+	name    string
+	compare func(tile *Tile, a *Flag, b *Flag) int
+}
+
+func (r *presetResolver) Compare(tile *Tile, a *Flag, b *Flag) int {
+	return r.compare(tile, a, b)
+}
+
+func (r *presetResolver) String() string {
+	return r.name
+}
+
+var (
+	// ResolveEarliest 先放置的旗子优先
+	ResolveEarliest ConflictResolver = &presetResolver{"earliest", compareEarliest}
+	// ResolveNearest 离地块近的旗子优先
+	ResolveNearest ConflictResolver = &presetResolver{"nearest", compareNearest}
+	// ResolveAnchorFirst 要塞类旗子优先
+	ResolveAnchorFirst ConflictResolver = &presetResolver{"anchor-first", compareAnchor}
+	// ResolveStrongest 旗子类型Priority高的优先
+	ResolveStrongest ConflictResolver = &presetResolver{"strongest", compareStrength}
+	// ResolveValidFirst 与要塞连通的旗子优先；有效性变化的旗子会重放。
+	// 有效性与归属互相决定，存在多种自洽的结果时，增量变更保留已有的有效性，可能与Rebuild从全部无效开始得到的结果不同
+	ResolveValidFirst ConflictResolver = &presetResolver{"valid-first", compareValidity}
+)
+
+// presetByName 按名字查找内置策略，找不到时返回nil
+func presetByName(name string) ConflictResolver {
+	for _, r := range []ConflictResolver{ResolveEarliest, ResolveNearest, ResolveAnchorFirst, ResolveStrongest, ResolveValidFirst} {
+		if r.(*presetResolver).name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// ChainResolvers 依次比较，前一个不分先后时才使用后一个
+func ChainResolvers(resolvers ...ConflictResolver) ConflictResolver {
+	return ConflictResolverFunc(func(tile *Tile, a *Flag, b *Flag) int {
+		for _, r := range resolvers {
+			if c := r.Compare(tile, a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// SetConflictResolver 设置重叠地块的裁决策略，地图上已有旗子时会重建
+func (m *Map) SetConflictResolver(resolver ConflictResolver) {
+	if resolver == nil {
+		resolver = ResolveEarliest
+	}
+	op := m.newOperation()
+	prev := m.resolver
+	op.record(func(op *operation) {
+		m.resolver = prev
+	})
+
+	m.resolver = resolver
+
+	if len(m.flags) > 0 {
+		m.rebuild(op)
+	}
+	op.finish()
+}
+
+func (m *Map) ConflictResolver() ConflictResolver {
+	return m.resolver
+}
+
+// prefer 判断challenger是否应从holder手中夺取tile，不分先后时按放置时间和ID决定，保证结果确定
+func (m *Map) prefer(tile *Tile, challenger *Flag, holder *Flag) bool {
+	if m.invalidPolicy == InvalidYield && challenger.IsValid != holder.IsValid {
+		return challenger.IsValid
+	}
+
+	if c := m.resolver.Compare(tile, challenger, holder); c != 0 {
+		return c < 0
+	}
+
+	return compareEarliest(tile, challenger, holder) < 0
+}
+
+func compareEarliest(tile *Tile, a *Flag, b *Flag) int {
+	ta, tb := a.MTime.UnixNano(), b.MTime.UnixNano()
+	switch {
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+func compareNearest(tile *Tile, a *Flag, b *Flag) int {
+	da, db := distanceSquare(tile, a), distanceSquare(tile, b)
+	switch {
+	case da < db:
+		return -1
+	case da > db:
+		return 1
+	}
+	return 0
+}
+
+func distanceSquare(tile *Tile, f *Flag) int64 {
+	dx := int64(tile.X - f.Tile.X)
+	dy := int64(tile.Y - f.Tile.Y)
+	return dx*dx + dy*dy
+}
+
+func compareAnchor(tile *Tile, a *Flag, b *Flag) int {
+	return compareBool(a.IsAnchor(), b.IsAnchor())
+}
+
+func compareStrength(tile *Tile, a *Flag, b *Flag) int {
+	pa, pb := a.Type.Priority, b.Type.Priority
+	switch {
+	case pa > pb:
+		return -1
+	case pa < pb:
+		return 1
+	}
+	return 0
+}
+
+func compareValidity(tile *Tile, a *Flag, b *Flag) int {
+	return compareBool(a.IsValid, b.IsValid)
+}
+
+// compareBool 为true的一方优先
+func compareBool(a bool, b bool) int {
+	switch {
+	case a && !b:
+		return -1
+	case !a && b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+// voronoiWorld 联盟1和联盟2的要塞相距10格，范围在x=3到7之间重叠，x=5到两者距离相等；
+// 联盟3的要塞在远处，不受两者影响
+func voronoiWorld(t *testing.T, mtimeA int64, mtimeB int64) (m *Map, a *Flag, b *Flag, far *Flag) {
+	m = NewMap()
+	m.SetConflictResolver(ResolveNearest)
+	add := func(x int32, allianceId int32, mtime int64) *Flag {
+		f, _, err := m.AddFlag(x, 0, allianceId, FlagTypeFortress, time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	a = add(0, 1, mtimeA)
+	b = add(10, 2, mtimeB)
+	far = add(100, 3, 0)
+	return m, a, b, far
+}
+
+func TestNearestOwnership(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		mtimeA, mtimeB int64
+	}{
+		{"a earlier", 0, 1},
+		{"b earlier", 1, 0},
+	} {
+		m, a, b, _ := voronoiWorld(t, c.mtimeA, c.mtimeB)
+		// 距离相等时先放置的旗子优先
+		tie := a
+		if c.mtimeB < c.mtimeA {
+			tie = b
+		}
+
+		for x := int32(3); x <= 7; x++ {
+			for y := int32(-7); y <= 7; y++ {
+				da, db := x*x+y*y, (x-10)*(x-10)+y*y
+				want := tie
+				if da < db {
+					want = a
+				} else if db < da {
+					want = b
+				}
+				if owner := m.ownerAt(x, y); owner != want {
+					t.Fatalf("%s: %d:%d owned by %v, want flag %d", c.name, x, y, owner, want.ID)
+				}
+			}
+		}
+	}
+}
+
+// 移除旗子只重新划分其范围内的地块
+func TestNearestRemovalIsLocal(t *testing.T) {
+	m, a, b, far := voronoiWorld(t, 0, 1)
+	farTiles := far.Bitmap.Count()
+
+	cs := m.RemoveFlag(b)
+	if len(cs.Tiles) == 0 {
+		t.Fatal("no tiles changed")
+	}
+	for _, tc := range cs.Tiles {
+		if !b.InArea(tc.X, tc.Y) {
+			t.Fatalf("%d:%d changed outside the removed flag's area", tc.X, tc.Y)
+		}
+		if tc.ToFlag != 0 && tc.ToFlag != a.ID {
+			t.Fatalf("%d:%d went to flag %d", tc.X, tc.Y, tc.ToFlag)
+		}
+	}
+	if n := a.Bitmap.Count(); n != 15*15 {
+		t.Fatalf("flag %d holds %d tiles after the removal, want its whole square", a.ID, n)
+	}
+	if far.Bitmap.Count() != farTiles {
+		t.Fatal("distant flag changed")
+	}
+}
@@ -0,0 +1,121 @@
+package logic
+
+import "container/heap"
+
+type costNode struct {
+	X    int32
+	Y    int32
+	Cost int32
+}
+
+type costQueue []costNode
+
+func (q costQueue) Len() int {
+	return len(q)
+}
+
+func (q costQueue) Less(i, j int) bool {
+	return q[i].Cost < q[j].Cost
+}
+
+func (q costQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *costQueue) Push(x interface{}) {
+	*q = append(*q, x.(costNode))
+}
+
+func (q *costQueue) Pop() interface{} {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
+
+// floodFlagAreaByCost 按路径消耗由近及远扩张（Dijkstra），进入每个地块消耗其地形的Cost，直到超出预算或形状
+func (m *Map) floodFlagAreaByCost(flag *Flag, claim func(x int32, y int32) bool) {
+	m.floodByCost(flag.Tile.X, flag.Tile.Y, flag.Radius, flag.Budget, flag.InArea, claim)
+}
+
+// floodByCost 从(x, y)出发在inArea范围内按路径消耗扩张，claim对起点以外、消耗不超过budget的地块各调用一次，
+// 返回false时不再经由该地块扩张
+func (m *Map) floodByCost(x int32, y int32, radius int32, budget int32, inArea func(x int32, y int32) bool, claim func(x int32, y int32) bool) {
+	side := radius*2 + 1
+
+	dist := make([]int32, side*side)
+	for i := range dist {
+		dist[i] = -1
+	}
+	settled := NewBitmap(radius)
+
+	index := func(nx int32, ny int32) int32 {
+		return (ny-y+radius)*side + nx - x + radius
+	}
+
+	queue := &costQueue{{X: x, Y: y}}
+	dist[index(x, y)] = 0
+
+	relax := func(from costNode, nx int32, ny int32) {
+		if !inArea(nx, ny) || m.isBlocked(nx, ny) {
+			return
+		}
+
+		cost := from.Cost + m.GetTerrain(nx, ny).Cost()
+		if cost > budget {
+			return
+		}
+
+		i := index(nx, ny)
+		if d := dist[i]; d >= 0 && d <= cost {
+			return
+		}
+
+		dist[i] = cost
+		heap.Push(queue, costNode{X: nx, Y: ny, Cost: cost})
+	}
+
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(costNode)
+		dx, dy := node.X-x, node.Y-y
+		if settled.Test(dx, dy) {
+			continue
+		}
+		settled.Set(dx, dy)
+
+		if node.Cost > 0 && !claim(node.X, node.Y) {
+			continue
+		}
+
+		relax(node, node.X-1, node.Y)
+		relax(node, node.X+1, node.Y)
+		relax(node, node.X, node.Y-1)
+		relax(node, node.X, node.Y+1)
+	}
+}
+
+// checkFlagSettableByCost 与checkFlagSettable相同，但只经由预算内能到达的无主地块寻找本联盟的领地
+func (m *Map) checkFlagSettableByCost(x int32, y int32, allianceId int32, flagType *FlagType) bool {
+	touches := func(x int32, y int32) bool {
+		for i := E; i <= N; i += 2 {
+			o := Orientations[i]
+			if owner := m.ownerAt(x+o.X, y+o.Y); owner != nil && owner.AllianceId == allianceId {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := touches(x, y)
+	inArea := func(nx int32, ny int32) bool {
+		return flagType.inArea(nx-x, ny-y)
+	}
+	m.floodByCost(x, y, flagType.Radius, flagType.Budget, inArea, func(nx int32, ny int32) bool {
+		if found || m.ownerAt(nx, ny) != nil {
+			return false
+		}
+		found = touches(nx, ny)
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,111 @@
+package logic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flagTypeCamp 按地形消耗扩张的旗子类型，只在测试中注册
+const flagTypeCamp = 100
+
+func init() {
+	if err := RegisterFlagType(&FlagType{ID: flagTypeCamp, Name: "camp", Radius: 5, Budget: 4, Priority: 1}); err != nil {
+		panic(err)
+	}
+}
+
+// 营地放在(0, 0)，依附于南边要塞的领地；各地块的归属取决于到达它的最小消耗
+func TestBudgetExpansionOverTerrain(t *testing.T) {
+	cases := []struct {
+		name    string
+		terrain map[Vector2]Terrain
+		claimed []Vector2
+		lost    []Vector2
+	}{
+		{
+			name:    "plain",
+			claimed: []Vector2{{4, 0}, {2, 2}, {0, 4}, {-4, 0}},
+			lost:    []Vector2{{5, 0}, {3, 2}, {0, -5}},
+		},
+		{
+			// 森林消耗2，穿过森林后剩下的预算只够再走一步
+			name:    "forest",
+			terrain: map[Vector2]Terrain{{1, 0}: TerrainForest, {2, 0}: TerrainForest},
+			claimed: []Vector2{{1, 0}, {2, 0}, {3, 1}, {-4, 0}},
+			lost:    []Vector2{{3, 0}, {4, 0}},
+		},
+		{
+			// 丘陵消耗3，绕路更便宜时走绕路
+			name:    "hill",
+			terrain: map[Vector2]Terrain{{1, 0}: TerrainHill},
+			claimed: []Vector2{{1, 0}, {2, 0}, {1, 1}, {3, 1}},
+			lost:    []Vector2{{3, 0}, {4, 0}},
+		},
+		{
+			// 水不能通过，只能绕行
+			name:    "water",
+			terrain: map[Vector2]Terrain{{1, -1}: TerrainWater, {1, 0}: TerrainWater, {1, 1}: TerrainWater},
+			claimed: []Vector2{{1, 2}, {2, 2}, {0, -3}},
+			lost:    []Vector2{{1, 0}, {2, 0}, {2, 1}},
+		},
+	}
+
+	for _, c := range cases {
+		m := NewMap()
+		for p, terrain := range c.terrain {
+			if err := m.SetTerrain(p.X, p.Y, terrain); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := m.AddFlag(0, 12, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+		camp, _, err := m.AddFlag(0, 0, 1, flagTypeCamp, time.Unix(1, 0))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		for _, p := range c.claimed {
+			if owner := m.ownerAt(p.X, p.Y); owner != camp {
+				t.Errorf("%s: %d:%d owned by %v, want the camp", c.name, p.X, p.Y, owner)
+			}
+		}
+		for _, p := range c.lost {
+			if owner := m.ownerAt(p.X, p.Y); owner == camp {
+				t.Errorf("%s: %d:%d claimed beyond the budget", c.name, p.X, p.Y)
+			}
+		}
+		if !camp.IsValid {
+			t.Errorf("%s: camp not connected to the fortress", c.name)
+		}
+		assertSameAsReference(t, m, referenceMap(m, nil), c.name)
+	}
+}
+
+// 形状内有己方领地，但路上的地形消耗超出预算时不能放置
+func TestBudgetBlocksPlacement(t *testing.T) {
+	m := NewMap()
+	if _, _, err := m.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 要塞的领地到x=7为止，营地放在x=10，中间隔着两列
+	if err := m.CanPlaceFlag(10, 0, 1, flagTypeCamp); err != nil {
+		t.Fatalf("plain: %v", err)
+	}
+
+	for y := int32(-5); y <= 5; y++ {
+		m.SetTerrain(8, y, TerrainHill)
+		m.SetTerrain(9, y, TerrainForest)
+	}
+	var pe *PlacementError
+	if err := m.CanPlaceFlag(10, 0, 1, flagTypeCamp); !errors.As(err, &pe) || pe.Err != ErrNoNeighbor {
+		t.Fatalf("behind hills: %v, want ErrNoNeighbor", err)
+	}
+
+	// 同样距离的无预算旗子不受地形消耗影响
+	if err := m.CanPlaceFlag(10, 0, 1, FlagTypeWatchtower); err != nil {
+		t.Fatalf("watchtower behind hills: %v", err)
+	}
+}
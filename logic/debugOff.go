@@ -0,0 +1,6 @@
+//go:build !territory_debug
+// +build !territory_debug
+
+package logic
+
+func (m *Map) checkInvariants() {}
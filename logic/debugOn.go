@@ -0,0 +1,13 @@
+//go:build territory_debug
+// +build territory_debug
+
+package logic
+
+import "fmt"
+
+// checkInvariants 以territory_debug标签编译时，每次变更结束后检查状态一致性
+func (m *Map) checkInvariants() {
+	if violations := m.Validate(); len(violations) > 0 {
+		panic(fmt.Sprintf("territory: %d violations, first: %v", len(violations), violations[0]))
+	}
+}
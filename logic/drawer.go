@@ -7,24 +7,22 @@ import (
 )
 
 func DrawImage(m *Map, image *image.RGBA, colors map[int32]color.RGBA) {
-	for x, row := range m.tiles {
-		for y, tile := range row {
-			isV := tile.IsFlag()
-			cl := colors[tile.GetAllianceId()]
-			if isV {
-				cl = color.RGBA{
-					0, 0, 0, 255,
-				}
-			} else {
-				cl.A = 8
+	m.tiles.each(func(x int32, y int32, owner *Flag) {
+		isV := owner.Tile.X == x && owner.Tile.Y == y
+		cl := colors[owner.AllianceId]
+		if isV {
+			cl = color.RGBA{
+				0, 0, 0, 255,
 			}
-			for i := 0; i < 4; i++ {
-				for j := 0; j < 4; j++ {
-					image.SetRGBA(int(x)*4+i, int(y)*4+j, cl)
-				}
+		} else {
+			cl.A = 8
+		}
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				image.SetRGBA(int(x)*4+i, int(y)*4+j, cl)
 			}
 		}
-	}
+	})
 }
 
 func DrawBoundaries(m *Map, image *image.RGBA, colors map[int32]color.RGBA) {
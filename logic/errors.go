@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownFlagType = errors.New("unknown flag type")
+	ErrUnknownTerrain  = errors.New("unknown terrain")
+	ErrBlocked         = errors.New("blocked")
+	ErrNotYours        = errors.New("not yours")
+	ErrOccupied        = errors.New("occupied")
+	ErrNoNeighbor      = errors.New("no neighbor")
+	ErrNotOnMap        = errors.New("flag not on map")
+)
+
+// PlacementError 放置旗子失败的原因，Err为上面的哨兵错误之一，可以用errors.Is判断
+type PlacementError struct {
+	Err        error
+	X          int32
+	Y          int32
+	AllianceId int32
+	TypeId     int32
+	Owner      *Flag   //占据该地块的旗子，只有ErrNotYours和ErrOccupied时不为nil
+	Terrain    Terrain //该地块的地形
+	Spec       int     //NewMapFromFlags中出错的旗子在specs中的下标，其他情况为-1
+}
+
+func (e *PlacementError) Error() string {
+	msg := fmt.Sprintf("%v: tile %d:%d", e.Err, e.X, e.Y)
+	if e.Owner != nil {
+		msg += fmt.Sprintf(" held by flag %d of alliance %d", e.Owner.ID, e.Owner.AllianceId)
+	}
+	if e.Spec >= 0 {
+		msg = fmt.Sprintf("flag spec %d: %s", e.Spec, msg)
+	}
+	return msg
+}
+
+func (e *PlacementError) Unwrap() error {
+	return e.Err
+}
+
+func (m *Map) placementError(err error, x int32, y int32, allianceId int32, typeId int32, owner *Flag) *PlacementError {
+	return &PlacementError{
+		Err:        err,
+		X:          x,
+		Y:          y,
+		AllianceId: allianceId,
+		TypeId:     typeId,
+		Owner:      owner,
+		Terrain:    m.GetTerrain(x, y),
+		Spec:       -1,
+	}
+}
+
+// CanPlaceFlag 判断能否在该地块放置旗子，不能时返回*PlacementError；不会修改地图
+func (m *Map) CanPlaceFlag(x int32, y int32, allianceId int32, typeId int32) error {
+	fail := func(err error, owner *Flag) error {
+		return m.placementError(err, x, y, allianceId, typeId, owner)
+	}
+
+	flagType := GetFlagType(typeId)
+	if flagType == nil {
+		return fail(ErrUnknownFlagType, nil)
+	}
+
+	if m.isBlocked(x, y) {
+		return fail(ErrBlocked, nil)
+	}
+
+	if t, ex := m.GetTile(x, y, false); ex {
+		if t.GetAllianceId() != allianceId {
+			return fail(ErrNotYours, t.OwnerFlag())
+		}
+
+		if !t.IsEmpty() {
+			return fail(ErrOccupied, t.OwnerFlag())
+		}
+	}
+
+	if !flagType.Standalone && !m.checkFlagSettable(x, y, allianceId, flagType) {
+		return fail(ErrNoNeighbor, nil)
+	}
+
+	return nil
+}
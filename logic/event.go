@@ -0,0 +1,98 @@
+package logic
+
+type EventType int
+
+const (
+	EventTileOwnerChanged      EventType = iota + 1 //X/Y地块归属由Other变为Flag，nil为无主
+	EventFlagAdded                                  //Flag放到了地图上
+	EventFlagRemoved                                //Flag从地图上移除
+	EventFlagValidityChanged                        //Flag的IsValid变为Valid
+	EventNeighborLinked                             //Flag与Other成为相邻旗子
+	EventNeighborUnlinked                           //Flag与Other不再相邻
+	EventAllianceBoundaryDirty                      //AllianceId的边界需要重绘，每次变更结束时发出
+)
+
+type Event struct {
+	Type       EventType
+	X          int32
+	Y          int32
+	Flag       *Flag
+	Other      *Flag
+	Valid      bool
+	AllianceId int32
+}
+
+// Listener 在变更过程中同步调用，不可以在回调中修改地图
+type Listener interface {
+	OnEvent(e *Event)
+}
+
+type ListenerFunc func(e *Event)
+
+func (fn ListenerFunc) OnEvent(e *Event) {
+	fn(e)
+}
+
+type listenerEntry struct {
+	id       int
+	listener Listener
+}
+
+// AddListener 注册监听者，返回用于注销的函数
+func (m *Map) AddListener(listener Listener) (remove func()) {
+	m.lastListenerId++
+	id := m.lastListenerId
+	m.listeners = append(m.listeners, listenerEntry{id, listener})
+
+	return func() {
+		for i, entry := range m.listeners {
+			if entry.id == id {
+				m.listeners = append(m.listeners[:i:i], m.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// SetBufferEvents 为true时事件先缓存，等一次变更全部完成后再按发生顺序派发
+func (m *Map) SetBufferEvents(buffer bool) {
+	m.bufferEvents = buffer
+}
+
+func (m *Map) dispatch(e *Event) {
+	for _, entry := range m.listeners {
+		entry.listener.OnEvent(e)
+	}
+}
+
+func (op *operation) emit(e Event) {
+	m := op.m
+	if op.silent || len(m.listeners) == 0 {
+		return
+	}
+
+	if m.bufferEvents || op.buffered {
+		op.events = append(op.events, e)
+		return
+	}
+
+	m.dispatch(&e)
+}
+
+// flushEvents 派发缓存的事件，最后通知边界需要重绘的联盟
+func (op *operation) flushEvents() {
+	m := op.m
+	events := op.events
+	op.events = nil
+	for i := range events {
+		m.dispatch(&events[i])
+	}
+
+	if op.silent || len(m.listeners) == 0 {
+		return
+	}
+
+	for _, allianceId := range op.changes.Alliances {
+		m.dispatch(&Event{Type: EventAllianceBoundaryDirty, AllianceId: allianceId})
+	}
+}
@@ -0,0 +1,81 @@
+package logic
+
+// 空间索引的格子边长为2^flagIndexBits
+const flagIndexBits = 5
+
+type cellKey struct {
+	X int32
+	Y int32
+}
+
+// Rect 闭区间矩形
+type Rect struct {
+	MinX int32
+	MinY int32
+	MaxX int32
+	MaxY int32
+}
+
+func (r Rect) Intersects(o Rect) bool {
+	return r.MinX <= o.MaxX && o.MinX <= r.MaxX && r.MinY <= o.MaxY && o.MinY <= r.MaxY
+}
+
+func (r Rect) Contains(x int32, y int32) bool {
+	return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+}
+
+// Bounds 旗子可能影响的范围：占领范围外扩一格，包含与之相邻的地块
+func (f *Flag) Bounds() Rect {
+	r := f.Radius + 1
+	return Rect{
+		MinX: f.Tile.X - r,
+		MinY: f.Tile.Y - r,
+		MaxX: f.Tile.X + r,
+		MaxY: f.Tile.Y + r,
+	}
+}
+
+func (m *Map) eachCell(r Rect, fn func(key cellKey)) {
+	for cx := r.MinX >> flagIndexBits; cx <= r.MaxX>>flagIndexBits; cx++ {
+		for cy := r.MinY >> flagIndexBits; cy <= r.MaxY>>flagIndexBits; cy++ {
+			fn(cellKey{cx, cy})
+		}
+	}
+}
+
+func (m *Map) indexFlag(f *Flag) {
+	m.eachCell(f.Bounds(), func(key cellKey) {
+		cell := m.index[key]
+		if cell == nil {
+			cell = make(map[*Flag]*Flag)
+			m.index[key] = cell
+		}
+		cell[f] = f
+	})
+}
+
+func (m *Map) unindexFlag(f *Flag) {
+	m.eachCell(f.Bounds(), func(key cellKey) {
+		cell := m.index[key]
+		delete(cell, f)
+		if len(cell) == 0 {
+			delete(m.index, key)
+		}
+	})
+}
+
+// flagsNear 返回影响范围与r相交的旗子
+func (m *Map) flagsNear(r Rect) map[*Flag]*Flag {
+	m.rlockShared()
+	defer m.runlockShared()
+
+	result := make(map[*Flag]*Flag)
+	m.eachCell(r, func(key cellKey) {
+		for f := range m.index[key] {
+			if result[f] == nil && f.Bounds().Intersects(r) {
+				result[f] = f
+			}
+		}
+	})
+	return result
+}
@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+)
+
+type FlagType struct {
+	ID         int32
+	Name       string
+	Radius     int32 //占领半径
+	Shape      Shape //占领形状
+	Budget     int32 //大于0时按地形消耗由近及远扩张，直到预算耗尽
+	IsAnchor   bool  //是否像要塞一样作为联盟连通性的起点
+	Priority   int   //争夺重叠地块时的优先级，越大越优先
+	Standalone bool  //是否可以不依附己方领地放置
+}
+
+var FlagTypes = make(map[int32]*FlagType)
+
+// inArea 判断偏移是否在该类型的占领范围内，形状超出radius围成的正方形的部分不算在内
+func (ft *FlagType) inArea(dx int32, dy int32) bool {
+	return ShapeSquare.Contains(dx, dy, ft.Radius) && ft.Shape.Contains(dx, dy, ft.Radius)
+}
+
+// RegisterFlagType 注册旗子类型，ID不可重复
+func RegisterFlagType(ft *FlagType) error {
+	if ft.ID <= 0 {
+		return errors.New("flag type id must be positive")
+	}
+
+	if ft.Radius < 0 || ft.Budget < 0 {
+		return fmt.Errorf("flag type %d: negative radius or budget", ft.ID)
+	}
+
+	if FlagTypes[ft.ID] != nil {
+		return fmt.Errorf("flag type %d already registered", ft.ID)
+	}
+
+	if ft.Shape == nil {
+		ft.Shape = ShapeSquare
+	}
+
+	if st, ok := ft.Shape.(*Stencil); ok {
+		ft.Radius = st.Radius()
+	}
+
+	FlagTypes[ft.ID] = ft
+	return nil
+}
+
+func GetFlagType(id int32) *FlagType {
+	return FlagTypes[id]
+}
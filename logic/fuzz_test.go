@@ -0,0 +1,775 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	opAdd = iota
+	opRemove
+	opTerrain
+)
+
+// fuzzOp 一步操作；Label是add操作的编号，remove通过Target引用它，缩减用例时不受下标变化影响
+type fuzzOp struct {
+	Kind       int
+	Label      int
+	Target     int
+	X          int32
+	Y          int32
+	AllianceId int32
+	TypeId     int32
+	MTime      int64
+	Terrain    Terrain
+}
+
+const fuzzWorldSize = 24
+
+var fuzzTerrains = []Terrain{TerrainPlain, TerrainWater, TerrainMountain, TerrainForest, TerrainHill}
+
+// decodeOps 每6个字节解码为一步操作
+func decodeOps(data []byte) []fuzzOp {
+	var ops []fuzzOp
+	var labels []int
+	for i := 0; i+6 <= len(data); i += 6 {
+		b := data[i : i+6]
+		switch kind := b[0] % 8; {
+		case kind < 5:
+			op := fuzzOp{
+				Kind:       opAdd,
+				Label:      len(ops),
+				X:          int32(b[1]) % fuzzWorldSize,
+				Y:          int32(b[2]) % fuzzWorldSize,
+				AllianceId: int32(b[3])%3 + 1,
+				TypeId:     flagTypeIds[int(b[4])%len(flagTypeIds)],
+				MTime:      int64(b[5]),
+			}
+			labels = append(labels, op.Label)
+			ops = append(ops, op)
+		case kind < 7:
+			if len(labels) == 0 {
+				continue
+			}
+			ops = append(ops, fuzzOp{Kind: opRemove, Target: labels[int(b[1])%len(labels)]})
+		default:
+			ops = append(ops, fuzzOp{
+				Kind:    opTerrain,
+				X:       int32(b[1]) % fuzzWorldSize,
+				Y:       int32(b[2]) % fuzzWorldSize,
+				Terrain: fuzzTerrains[int(b[3])%len(fuzzTerrains)],
+			})
+		}
+	}
+	return ops
+}
+
+// refFlag 参照模型中的旗子
+type refFlag struct {
+	ID         int32
+	AllianceId int32
+	Pos        Vector2
+	Type       *FlagType
+	MTime      int64
+}
+
+// refModel 暴力参照模型：每次都从头按放置顺序依次扩张，不做任何增量维护
+type refModel struct {
+	flags    map[int]*refFlag
+	terrain  map[Vector2]Terrain
+	resolver ConflictResolver
+	valid    map[int32]bool //裁决时使用的有效性，只对ResolveValidFirst有意义
+}
+
+func newRefModel() *refModel {
+	return &refModel{
+		flags:    make(map[int]*refFlag),
+		terrain:  make(map[Vector2]Terrain),
+		resolver: ResolveEarliest,
+	}
+}
+
+func (r *refModel) blocked(p Vector2) bool {
+	return r.terrain[p].IsBlocking()
+}
+
+func refEarlier(a *refFlag, b *refFlag) bool {
+	if a.MTime != b.MTime {
+		return a.MTime < b.MTime
+	}
+	return a.ID < b.ID
+}
+
+func sortRefFlags(set map[*refFlag]bool) []*refFlag {
+	var flags []*refFlag
+	for f := range set {
+		flags = append(flags, f)
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return refEarlier(flags[i], flags[j])
+	})
+	return flags
+}
+
+// prefer 按r.resolver判断a是否应从b手中夺取p，不分先后时早放置的优先
+func (r *refModel) prefer(p Vector2, a *refFlag, b *refFlag) bool {
+	flag := func(f *refFlag) *Flag {
+		return &Flag{ID: f.ID, AllianceId: f.AllianceId, Tile: &Tile{Vector2: f.Pos}, Type: f.Type, MTime: time.Unix(0, f.MTime), IsValid: r.valid[f.ID]}
+	}
+	if c := r.resolver.Compare(&Tile{Vector2: p}, flag(a), flag(b)); c != 0 {
+		return c < 0
+	}
+	return refEarlier(a, b)
+}
+
+// ownership 归属取决于有效性时与Rebuild相同，从全部无效开始，按上一轮的有效性重新放置，直到有效性不再变化
+func (r *refModel) ownership() map[Vector2]*refFlag {
+	r.valid = nil
+	owner := r.place()
+	if r.resolver != ResolveValidFirst {
+		return owner
+	}
+
+	for pass := 0; pass < maxRepartitionPasses; pass++ {
+		valid := r.validity(owner)
+		changed := false
+		for id, v := range valid {
+			if r.valid[id] != v {
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		r.valid = valid
+		owner = r.place()
+	}
+	return owner
+}
+
+// place 依次放置旗子：新旗子夺走地块时，失主及与其重叠的旗子按放置顺序重新扩张，直到没有地块易主
+func (r *refModel) place() map[Vector2]*refFlag {
+	all := make(map[*refFlag]bool)
+	for _, f := range r.flags {
+		all[f] = true
+	}
+
+	owner := make(map[Vector2]*refFlag)
+	overlaps := make(map[*refFlag]map[*refFlag]bool)
+	var stolen map[*refFlag]bool
+
+	// take 让f占领p，返回能否经由p继续扩张
+	take := func(f *refFlag, p Vector2) bool {
+		o := owner[p]
+		if o == nil || o == f {
+			owner[p] = f
+			return true
+		}
+
+		if overlaps[f] == nil {
+			overlaps[f] = make(map[*refFlag]bool)
+		}
+		if overlaps[o] == nil {
+			overlaps[o] = make(map[*refFlag]bool)
+		}
+		overlaps[f][o] = true
+		overlaps[o][f] = true
+
+		if o.Pos != p && r.prefer(p, f, o) {
+			owner[p] = f
+			stolen[o] = true
+			return true
+		}
+		return o.AllianceId == f.AllianceId
+	}
+
+	expand := func(f *refFlag) {
+		if f.Type.Budget > 0 {
+			r.reachable(f.Pos, f.Type, func(p Vector2) bool {
+				return take(f, p)
+			})
+			return
+		}
+
+		visited := map[Vector2]bool{f.Pos: true}
+		queue := []Vector2{f.Pos}
+		for len(queue) > 0 {
+			p := queue[0]
+			queue = queue[1:]
+			for _, d := range []Vector2{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				n := Vector2{p.X + d.X, p.Y + d.Y}
+				if visited[n] || r.blocked(n) || !f.Type.Shape.Contains(n.X-f.Pos.X, n.Y-f.Pos.Y, f.Type.Radius) {
+					continue
+				}
+				visited[n] = true
+				if take(f, n) {
+					queue = append(queue, n)
+				}
+			}
+		}
+	}
+
+	for _, f := range sortRefFlags(all) {
+		owner[f.Pos] = f
+		stolen = make(map[*refFlag]bool)
+		expand(f)
+
+		pending := stolen
+		for pass := 0; len(pending) > 0 && pass < maxRepartitionPasses; pass++ {
+			stolen = make(map[*refFlag]bool)
+			for _, g := range sortRefFlags(pending) {
+				expand(g)
+			}
+
+			pending = make(map[*refFlag]bool)
+			for victim := range stolen {
+				pending[victim] = true
+				for o := range overlaps[victim] {
+					pending[o] = true
+				}
+			}
+		}
+	}
+	return owner
+}
+
+// reachable 按地形消耗求出从from出发在预算和形状范围内能到达的地块及其路径消耗，pass为false的地块不能经过
+func (r *refModel) reachable(from Vector2, ft *FlagType, pass func(p Vector2) bool) map[Vector2]int32 {
+	dist := map[Vector2]int32{from: 0}
+	done := make(map[Vector2]bool)
+	for {
+		// 每次取出未确定的地块中消耗最小的一个
+		var cur Vector2
+		best := int32(-1)
+		for p, d := range dist {
+			if !done[p] && (best < 0 || d < best) {
+				cur, best = p, d
+			}
+		}
+		if best < 0 {
+			return dist
+		}
+		done[cur] = true
+		if cur != from && !pass(cur) {
+			continue
+		}
+
+		for _, d := range []Vector2{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+			n := Vector2{cur.X + d.X, cur.Y + d.Y}
+			if r.blocked(n) || !ft.Shape.Contains(n.X-from.X, n.Y-from.Y, ft.Radius) {
+				continue
+			}
+			cost := best + r.terrain[n].Cost()
+			if old, ok := dist[n]; cost <= ft.Budget && (!ok || cost < old) {
+				dist[n] = cost
+			}
+		}
+	}
+}
+
+// validity 旗子的领地上下左右相邻即相连，能连到要塞的旗子有效
+func (r *refModel) validity(owner map[Vector2]*refFlag) map[int32]bool {
+	links := make(map[*refFlag]map[*refFlag]bool)
+	for p, f := range owner {
+		for _, d := range []Vector2{{1, 0}, {0, 1}} {
+			o := owner[Vector2{p.X + d.X, p.Y + d.Y}]
+			if o != nil && o != f && o.AllianceId == f.AllianceId {
+				if links[f] == nil {
+					links[f] = make(map[*refFlag]bool)
+				}
+				if links[o] == nil {
+					links[o] = make(map[*refFlag]bool)
+				}
+				links[f][o] = true
+				links[o][f] = true
+			}
+		}
+	}
+
+	valid := make(map[int32]bool)
+	var queue []*refFlag
+	for _, f := range r.flags {
+		valid[f.ID] = f.Type.IsAnchor
+		if f.Type.IsAnchor {
+			queue = append(queue, f)
+		}
+	}
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		for o := range links[f] {
+			if !valid[o.ID] {
+				valid[o.ID] = true
+				queue = append(queue, o)
+			}
+		}
+	}
+	return valid
+}
+
+// canPlace 参照模型对AddFlag能否成功的判断
+func (r *refModel) canPlace(op fuzzOp, owner map[Vector2]*refFlag) bool {
+	p := Vector2{op.X, op.Y}
+	ft := GetFlagType(op.TypeId)
+	if r.blocked(p) {
+		return false
+	}
+
+	if o := owner[p]; o != nil && (o.AllianceId != op.AllianceId || o.Pos == p) {
+		return false
+	}
+
+	if ft.Standalone {
+		return true
+	}
+
+	touches := func(p Vector2) bool {
+		for _, d := range []Vector2{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			if o := owner[Vector2{p.X + d.X, p.Y + d.Y}]; o != nil && o.AllianceId == op.AllianceId {
+				return true
+			}
+		}
+		return false
+	}
+	if ft.Budget > 0 {
+		for n := range r.reachable(p, ft, func(n Vector2) bool { return owner[n] == nil }) {
+			if (n == p || owner[n] == nil) && touches(n) {
+				return true
+			}
+		}
+		return false
+	}
+
+	visited := map[Vector2]bool{p: true}
+	queue := []Vector2{p}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, d := range []Vector2{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			n := Vector2{cur.X + d.X, cur.Y + d.Y}
+			if o := owner[n]; o != nil {
+				if o.AllianceId == op.AllianceId {
+					return true
+				}
+				continue
+			}
+			if !visited[n] && !r.blocked(n) && ft.Shape.Contains(n.X-p.X, n.Y-p.Y, ft.Radius) {
+				visited[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return false
+}
+
+// runOps 依次执行操作，每一步后比较增量地图与参照模型
+func runOps(ops []fuzzOp) error {
+	m := NewMap()
+	ref := newRefModel()
+	flags := make(map[int]*Flag)
+	shadow := newEventShadow()
+	m.AddListener(shadow)
+
+	for i, op := range ops {
+		m.SetBufferEvents(i%2 == 1)
+		beforeTiles, beforeValid := ownership(m), validity(m)
+		var cs *ChangeSet
+
+		switch op.Kind {
+		case opAdd:
+			want := ref.canPlace(op, ref.ownership())
+			dryRun := m.CanPlaceFlag(op.X, op.Y, op.AllianceId, op.TypeId)
+			preview, _ := m.PreviewAddFlag(op.X, op.Y, op.AllianceId, op.TypeId)
+			inOrder := !time.Unix(op.MTime, 0).Before(m.lastMTime)
+			f, changes, err := m.AddFlag(op.X, op.Y, op.AllianceId, op.TypeId, time.Unix(op.MTime, 0))
+			if want != (err == nil) {
+				return fmt.Errorf("step %d: AddFlag err = %v, reference allows = %v", i, err, want)
+			}
+			if (dryRun == nil) != (err == nil) {
+				return fmt.Errorf("step %d: CanPlaceFlag = %v, AddFlag = %v", i, dryRun, err)
+			}
+			if err != nil {
+				var pe *PlacementError
+				if !errors.As(err, &pe) {
+					return fmt.Errorf("step %d: AddFlag returned %T, want *PlacementError", i, err)
+				}
+				continue
+			}
+
+			if inOrder {
+				if err := comparePreview(preview, f, beforeValid); err != nil {
+					return fmt.Errorf("step %d: %v", i, err)
+				}
+			}
+
+			cs = changes
+			flags[op.Label] = f
+			ref.flags[op.Label] = &refFlag{
+				ID:         f.ID,
+				AllianceId: op.AllianceId,
+				Pos:        Vector2{op.X, op.Y},
+				Type:       f.Type,
+				MTime:      op.MTime,
+			}
+		case opRemove:
+			f := flags[op.Target]
+			if f == nil {
+				continue
+			}
+			cs = m.RemoveFlag(f)
+			delete(flags, op.Target)
+			delete(ref.flags, op.Target)
+		case opTerrain:
+			p := Vector2{op.X, op.Y}
+			onFlag := false
+			for _, f := range ref.flags {
+				onFlag = onFlag || f.Pos == p
+			}
+			want := !(onFlag && op.Terrain.IsBlocking())
+			err := m.SetTerrain(op.X, op.Y, op.Terrain)
+			if want != (err == nil) {
+				return fmt.Errorf("step %d: SetTerrain err = %v, reference allows = %v", i, err, want)
+			}
+			if err == nil {
+				ref.terrain[p] = op.Terrain
+			}
+		}
+
+		if err := compareWithRef(m, ref); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+
+		if err := shadow.compare(m); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+
+		if cs != nil {
+			if err := compareChangeSet(cs, beforeTiles, beforeValid, m); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// comparePreview 按时间顺序放置时，预览应与实际放置的结果一致；before为放置前各旗子的有效性
+func comparePreview(p *Preview, f *Flag, before map[int32]bool) error {
+	if p == nil {
+		return errors.New("no preview for a successful placement")
+	}
+
+	claimed := len(p.Gained) + len(p.Won)
+	if claimed != f.Bitmap.Count() {
+		return fmt.Errorf("preview claims %d tiles, flag %d got %d", claimed, f.ID, f.Bitmap.Count())
+	}
+	for _, pos := range append(p.Gained, p.Won...) {
+		if !f.Bitmap.Test(pos.X-f.Tile.X, pos.Y-f.Tile.Y) {
+			return fmt.Errorf("preview claims %d,%d, flag %d did not", pos.X, pos.Y, f.ID)
+		}
+	}
+
+	if p.Valid != f.IsValid {
+		return fmt.Errorf("preview valid = %v, flag %d valid = %v", p.Valid, f.ID, f.IsValid)
+	}
+	predicted := make(map[*Flag]bool)
+	for _, flag := range p.Reconnected {
+		predicted[flag] = true
+	}
+	for _, flag := range p.Disconnected {
+		predicted[flag] = false
+	}
+	for _, flags := range f.Map.flags {
+		for flag := range flags {
+			valid, ok := predicted[flag]
+			if !ok {
+				valid = before[flag.ID]
+			}
+			if flag != f && flag.IsValid != valid {
+				return fmt.Errorf("preview predicts flag %d valid = %v, got %v", flag.ID, valid, flag.IsValid)
+			}
+		}
+	}
+	if len(p.Neighbors) != len(f.Neighbors) {
+		return fmt.Errorf("preview has %d neighbors, flag %d has %d", len(p.Neighbors), f.ID, len(f.Neighbors))
+	}
+	return nil
+}
+
+// eventShadow 只根据事件维护一份地图状态，用来检查事件是否完整
+type eventShadow struct {
+	tiles map[Vector2]*Flag
+	links map[*Flag]map[*Flag]bool
+	valid map[*Flag]bool
+}
+
+func newEventShadow() *eventShadow {
+	return &eventShadow{
+		tiles: make(map[Vector2]*Flag),
+		links: make(map[*Flag]map[*Flag]bool),
+		valid: make(map[*Flag]bool),
+	}
+}
+
+func (s *eventShadow) OnEvent(e *Event) {
+	switch e.Type {
+	case EventTileOwnerChanged:
+		if e.Flag == nil {
+			delete(s.tiles, Vector2{e.X, e.Y})
+		} else {
+			s.tiles[Vector2{e.X, e.Y}] = e.Flag
+		}
+	case EventFlagValidityChanged:
+		s.valid[e.Flag] = e.Valid
+	case EventFlagRemoved:
+		delete(s.valid, e.Flag)
+	case EventNeighborLinked, EventNeighborUnlinked:
+		for _, pair := range [][2]*Flag{{e.Flag, e.Other}, {e.Other, e.Flag}} {
+			if s.links[pair[0]] == nil {
+				s.links[pair[0]] = make(map[*Flag]bool)
+			}
+			if e.Type == EventNeighborLinked {
+				s.links[pair[0]][pair[1]] = true
+			} else {
+				delete(s.links[pair[0]], pair[1])
+			}
+		}
+	}
+}
+
+func (s *eventShadow) compare(m *Map) error {
+	got := ownership(m)
+	if len(got) != len(s.tiles) {
+		return fmt.Errorf("events describe %d owned tiles, map has %d", len(s.tiles), len(got))
+	}
+	for pos, f := range s.tiles {
+		if got[pos] != f.ID {
+			return fmt.Errorf("events say tile %d,%d is owned by flag %d, map says %d", pos.X, pos.Y, f.ID, got[pos])
+		}
+	}
+
+	for _, f := range m.sortedFlags() {
+		if s.valid[f] != f.IsValid {
+			return fmt.Errorf("events say flag %d valid = %v, map says %v", f.ID, s.valid[f], f.IsValid)
+		}
+		if len(s.links[f]) != len(f.Neighbors) {
+			return fmt.Errorf("events say flag %d has %d neighbors, map says %d", f.ID, len(s.links[f]), len(f.Neighbors))
+		}
+		for n := range f.Neighbors {
+			if !s.links[f][n] {
+				return fmt.Errorf("events miss link between flags %d and %d", f.ID, n.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// compareChangeSet 变更结果应与前后两次全图对比的差异一致
+func compareChangeSet(cs *ChangeSet, beforeTiles map[Vector2]int32, beforeValid map[int32]bool, m *Map) error {
+	afterTiles, afterValid := ownership(m), validity(m)
+
+	changed := make(map[Vector2]int32)
+	for pos, id := range beforeTiles {
+		if afterTiles[pos] != id {
+			changed[pos] = afterTiles[pos]
+		}
+	}
+	for pos, id := range afterTiles {
+		if beforeTiles[pos] != id {
+			changed[pos] = id
+		}
+	}
+
+	if len(cs.Tiles) != len(changed) {
+		return fmt.Errorf("change set has %d tiles, map changed %d", len(cs.Tiles), len(changed))
+	}
+	for _, tc := range cs.Tiles {
+		to, ok := changed[tc.Vector2]
+		if !ok || to != tc.ToFlag || beforeTiles[tc.Vector2] != tc.FromFlag {
+			return fmt.Errorf("change set tile %+v does not match map", tc)
+		}
+	}
+
+	flipped := 0
+	for id, valid := range afterValid {
+		if was, ok := beforeValid[id]; ok && was != valid {
+			flipped++
+		}
+	}
+	for _, f := range cs.Validity {
+		if was, ok := beforeValid[f.ID]; ok && was == f.IsValid {
+			return fmt.Errorf("change set reports flag %d flipped, it did not", f.ID)
+		}
+		if _, ok := beforeValid[f.ID]; !ok {
+			flipped++
+		}
+	}
+	if flipped != len(cs.Validity) {
+		return fmt.Errorf("change set has %d validity flips, map has %d", len(cs.Validity), flipped)
+	}
+	return nil
+}
+
+func compareWithRef(m *Map, ref *refModel) error {
+	if violations := m.Validate(); len(violations) > 0 {
+		return fmt.Errorf("%d violations, first: %v", len(violations), violations[0])
+	}
+
+	owner := ref.ownership()
+	got := ownership(m)
+	for p, f := range owner {
+		if got[p] != f.ID {
+			return fmt.Errorf("tile %d,%d owned by flag %d, want %d", p.X, p.Y, got[p], f.ID)
+		}
+	}
+	for p, id := range got {
+		if owner[p] == nil {
+			return fmt.Errorf("tile %d,%d owned by flag %d, want none", p.X, p.Y, id)
+		}
+	}
+
+	gotValid := validity(m)
+	for id, valid := range ref.validity(owner) {
+		if gotValid[id] != valid {
+			return fmt.Errorf("flag %d valid = %v, want %v", id, gotValid[id], valid)
+		}
+	}
+	return nil
+}
+
+// shrinkOps 反复删去操作片段，只要仍然失败就保留删减，得到尽量短的复现用例
+func shrinkOps(ops []fuzzOp) []fuzzOp {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]fuzzOp(nil), ops[:start]...), ops[start+chunk:]...)
+			if runOps(candidate) != nil {
+				ops = candidate
+			} else {
+				start += chunk
+			}
+		}
+	}
+	return ops
+}
+
+// formatScript 把操作序列写成可读的脚本，可以粘贴到TestFuzzRegressions里
+func formatScript(ops []fuzzOp) string {
+	var b strings.Builder
+	for _, op := range ops {
+		switch op.Kind {
+		case opAdd:
+			fmt.Fprintf(&b, "f%d = add %d %d %d %s %d\n", op.Label, op.X, op.Y, op.AllianceId, GetFlagType(op.TypeId).Name, op.MTime)
+		case opRemove:
+			fmt.Fprintf(&b, "remove f%d\n", op.Target)
+		case opTerrain:
+			fmt.Fprintf(&b, "terrain %d %d %s\n", op.X, op.Y, op.Terrain.Type().Name)
+		}
+	}
+	return b.String()
+}
+
+func parseScript(script string) ([]fuzzOp, error) {
+	typeIds := make(map[string]int32)
+	for id, ft := range FlagTypes {
+		typeIds[ft.Name] = id
+	}
+	terrains := make(map[string]Terrain)
+	for t, tt := range TerrainTypes {
+		terrains[tt.Name] = t
+	}
+
+	atoi := func(s string) int64 {
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	label := func(s string) int {
+		return int(atoi(strings.TrimPrefix(s, "f")))
+	}
+
+	var ops []fuzzOp
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 8 && fields[2] == "add":
+			ops = append(ops, fuzzOp{
+				Kind:       opAdd,
+				Label:      label(fields[0]),
+				X:          int32(atoi(fields[3])),
+				Y:          int32(atoi(fields[4])),
+				AllianceId: int32(atoi(fields[5])),
+				TypeId:     typeIds[fields[6]],
+				MTime:      atoi(fields[7]),
+			})
+		case len(fields) == 2 && fields[0] == "remove":
+			ops = append(ops, fuzzOp{Kind: opRemove, Target: label(fields[1])})
+		case len(fields) == 4 && fields[0] == "terrain":
+			ops = append(ops, fuzzOp{
+				Kind:    opTerrain,
+				X:       int32(atoi(fields[1])),
+				Y:       int32(atoi(fields[2])),
+				Terrain: terrains[fields[3]],
+			})
+		default:
+			return nil, fmt.Errorf("bad script line %q", line)
+		}
+	}
+	return ops, nil
+}
+
+func checkOps(t *testing.T, ops []fuzzOp) {
+	t.Helper()
+	if err := runOps(ops); err != nil {
+		shrunk := shrinkOps(ops)
+		t.Fatalf("%v\nminimal reproducer (%v):\n%s", err, runOps(shrunk), formatScript(shrunk))
+	}
+}
+
+func FuzzAddRemove(f *testing.F) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 32; i++ {
+		data := make([]byte, 6*40)
+		rnd.Read(data)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkOps(t, decodeOps(data))
+	})
+}
+
+var fuzzRegressions = []string{
+	// 先放的旗子插到已有旗子之前，并落在其领地上
+	`
+f0 = add 5 5 1 fortress 10
+f1 = add 9 5 1 watchtower 20
+f2 = add 12 5 2 capital 5
+remove f0
+`,
+	// 河流把领地截成两段，移除后被挡住的联盟重新扩张过来
+	`
+terrain 8 4 water
+terrain 8 5 water
+terrain 8 6 water
+f0 = add 4 5 1 fortress 1
+f1 = add 12 5 2 fortress 2
+f2 = add 7 2 1 outpost 3
+remove f2
+remove f0
+`,
+}
+
+func TestFuzzRegressions(t *testing.T) {
+	for i, script := range fuzzRegressions {
+		ops, err := parseScript(script)
+		if err != nil {
+			t.Fatalf("script %d: %v", i, err)
+		}
+		checkOps(t, ops)
+	}
+}
@@ -0,0 +1,103 @@
+package logic
+
+import "time"
+
+// InvalidPolicy 与要塞断开连接的旗子如何处理其领地
+type InvalidPolicy int
+
+const (
+	InvalidKeep    InvalidPolicy = iota //保留领地
+	InvalidYield                        //任意联盟的有效旗子都可以夺取其领地
+	InvalidRelease                      //超过宽限期后领地还原为无主，只保留旗子所在地块
+)
+
+// SetInvalidPolicy 设置失效旗子的处理方式，gracePeriod只对InvalidRelease有效；地图上已有旗子时会重建
+func (m *Map) SetInvalidPolicy(policy InvalidPolicy, gracePeriod time.Duration) {
+	op := m.newOperation()
+	prevPolicy, prevGrace := m.invalidPolicy, m.gracePeriod
+	op.record(func(op *operation) {
+		m.invalidPolicy, m.gracePeriod = prevPolicy, prevGrace
+	})
+
+	m.invalidPolicy = policy
+	m.gracePeriod = gracePeriod
+
+	if len(m.flags) > 0 {
+		m.rebuild(op)
+	}
+	op.finish()
+}
+
+func (m *Map) InvalidPolicy() (InvalidPolicy, time.Duration) {
+	return m.invalidPolicy, m.gracePeriod
+}
+
+// SetClock 设置记录旗子失效时间所用的时钟
+func (m *Map) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	m.clock = clock
+}
+
+// Tick 在InvalidRelease下释放失效已超过宽限期的旗子的领地，没有旗子到期时返回nil
+func (m *Map) Tick(now time.Time) *ChangeSet {
+	if m.invalidPolicy != InvalidRelease {
+		return nil
+	}
+
+	op := m.newOperation()
+	var expired []*Flag
+	for _, flags := range m.flags {
+		for flag := range flags {
+			if flag.IsValid || flag.Released || flag.InvalidAt.IsZero() || now.Sub(flag.InvalidAt) < m.gracePeriod {
+				continue
+			}
+
+			op.setReleased(flag, true)
+			expired = append(expired, flag)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	m.replay(op, m.affectedFlags(expired...))
+	op.finish()
+
+	return op.changes
+}
+
+// resolveValidity 有效性变化后按策略重放相关旗子
+func (m *Map) resolveValidity(op *operation) {
+	if len(op.flipped) == 0 {
+		return
+	}
+
+	var seeds []*Flag
+	for flag := range op.flipped {
+		if !m.hasFlag(flag) {
+			continue
+		}
+
+		// 释放领地的旗子恢复有效后重新扩张
+		reclaim := m.invalidPolicy == InvalidRelease && flag.IsValid && flag.Released
+		if reclaim {
+			op.setReleased(flag, false)
+		}
+
+		if reclaim || m.validityMatters() {
+			seeds = append(seeds, flag)
+		}
+	}
+
+	if len(seeds) > 0 {
+		m.replay(op, m.affectedFlags(seeds...))
+	}
+}
+
+// validityMatters 重叠地块的归属是否取决于旗子的有效性，此时有效性变化的旗子都要重放
+func (m *Map) validityMatters() bool {
+	return m.invalidPolicy == InvalidYield || m.resolver == ResolveValidFirst
+}
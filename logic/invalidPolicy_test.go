@@ -0,0 +1,108 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+// cutOffWorld 联盟1的要塞经由前哨连到瞭望塔，联盟2的要塞与瞭望塔的领地重叠：
+// 要塞(0, 0)领地到x=7，前哨(8, 0)补上x=8，瞭望塔(16, 0)领地从x=9到23，联盟2的要塞(28, 0)从x=21开始
+func cutOffWorld(t *testing.T, policy InvalidPolicy, now *time.Time) (m *Map, bridge *Flag, tower *Flag) {
+	m = NewMap()
+	m.SetClock(func() time.Time { return *now })
+	m.SetInvalidPolicy(policy, time.Minute)
+
+	add := func(x int32, allianceId int32, typeId int32, mtime int64) *Flag {
+		f, _, err := m.AddFlag(x, 0, allianceId, typeId, time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	add(0, 1, FlagTypeFortress, 0)
+	bridge = add(8, 1, FlagTypeOutpost, 1)
+	tower = add(16, 1, FlagTypeWatchtower, 2)
+	add(28, 2, FlagTypeFortress, 3)
+
+	if !tower.IsValid || m.ownerAt(22, 0) != tower {
+		t.Fatalf("tower valid = %v, 22:0 owned by %v", tower.IsValid, m.ownerAt(22, 0))
+	}
+	return m, bridge, tower
+}
+
+// reconnect 在前哨原来的位置附近放置瞭望塔，其领地与失效的瞭望塔所在地块相邻
+func reconnect(t *testing.T, m *Map, tower *Flag) {
+	if _, _, err := m.AddFlag(10, 0, 1, FlagTypeWatchtower, time.Unix(4, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !tower.IsValid {
+		t.Fatal("tower still invalid after reconnecting")
+	}
+}
+
+func TestInvalidYield(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m, bridge, tower := cutOffWorld(t, InvalidYield, &now)
+
+	m.RemoveFlag(bridge)
+	if tower.IsValid {
+		t.Fatal("tower still valid after losing its bridge")
+	}
+	// 重叠的地块立即让给有效的旗子，其余地块保留
+	if owner := m.ownerAt(22, 0); owner == nil || owner.AllianceId != 2 {
+		t.Fatalf("22:0 owned by %v, want alliance 2", owner)
+	}
+	if m.ownerAt(12, 0) != tower {
+		t.Fatal("tower lost uncontested tiles")
+	}
+
+	// 宽限期只对InvalidRelease有效
+	now = now.Add(2 * time.Minute)
+	if cs := m.Tick(now); cs != nil {
+		t.Fatalf("Tick under InvalidYield changed %d tiles", len(cs.Tiles))
+	}
+
+	reconnect(t, m, tower)
+	if m.ownerAt(22, 0) != tower {
+		t.Fatalf("22:0 owned by %v after reconnecting, want the tower", m.ownerAt(22, 0))
+	}
+	assertSameAsReference(t, m, referenceMap(m, nil), "after reconnecting")
+}
+
+func TestInvalidRelease(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m, bridge, tower := cutOffWorld(t, InvalidRelease, &now)
+
+	// 前哨早于瞭望塔，移除后瞭望塔得到前哨的部分地块
+	m.RemoveFlag(bridge)
+	count := tower.Bitmap.Count()
+	if tower.IsValid || !tower.InvalidAt.Equal(now) {
+		t.Fatalf("tower valid = %v, invalid at %v", tower.IsValid, tower.InvalidAt)
+	}
+
+	// 宽限期内领地保持不变
+	if cs := m.Tick(now.Add(30 * time.Second)); cs != nil || tower.Bitmap.Count() != count {
+		t.Fatalf("Tick within the grace period released the tower: %d tiles left", tower.Bitmap.Count())
+	}
+
+	// 超过宽限期后只保留旗子所在地块，重叠的地块归联盟2
+	cs := m.Tick(now.Add(2 * time.Minute))
+	if cs == nil || !tower.Released || tower.Bitmap.Count() != 1 {
+		t.Fatalf("Tick after the grace period: released = %v, %d tiles left", tower.Released, tower.Bitmap.Count())
+	}
+	if m.ownerAt(12, 0) != nil {
+		t.Fatalf("12:0 owned by %v, want none", m.ownerAt(12, 0))
+	}
+	if owner := m.ownerAt(22, 0); owner == nil || owner.AllianceId != 2 {
+		t.Fatalf("22:0 owned by %v, want alliance 2", owner)
+	}
+	if m.Tick(now.Add(3*time.Minute)) != nil {
+		t.Fatal("released tower released again")
+	}
+
+	// 重新连通后收回领地，只有新瞭望塔所在的地块除外
+	reconnect(t, m, tower)
+	if tower.Released || tower.Bitmap.Count() != count-1 || m.ownerAt(22, 0) != tower {
+		t.Fatalf("after reconnecting: released = %v, %d tiles, want %d", tower.Released, tower.Bitmap.Count(), count-1)
+	}
+}
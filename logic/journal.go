@@ -0,0 +1,203 @@
+package logic
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultJournalLimit 默认保留的可撤销变更数
+const DefaultJournalLimit = 64
+
+var ErrMarkExpired = errors.New("journal mark expired")
+
+// JournalMark 日志中的位置，RollbackTo可以回到这个位置时的状态
+type JournalMark int
+
+// undoFunc 撤销一处修改，按记录的相反顺序执行
+type undoFunc func(op *operation)
+
+// SetJournalLimit 设置保留的可撤销变更数，0表示不记录；超出的最早的变更不能再撤销
+func (m *Map) SetJournalLimit(steps int) {
+	if steps < 0 {
+		steps = 0
+	}
+	m.journalLimit = steps
+	m.trimJournal()
+}
+
+// Mark 返回当前位置，之后可以用RollbackTo回到此时的状态
+func (m *Map) Mark() JournalMark {
+	return JournalMark(m.journalPos())
+}
+
+// Undo 撤销最近一次变更，没有可撤销的变更时返回nil
+func (m *Map) Undo() *ChangeSet {
+	if len(m.steps) == 0 {
+		return nil
+	}
+
+	cs, _ := m.RollbackTo(JournalMark(m.steps[len(m.steps)-1]))
+	return cs
+}
+
+// RollbackTo 撤销mark之后的所有变更，恢复到取mark时的状态，不需要重建
+func (m *Map) RollbackTo(mark JournalMark) (*ChangeSet, error) {
+	pos := int(mark)
+	if m.journalLimit == 0 || pos < m.journalBase || pos > m.journalPos() {
+		return nil, ErrMarkExpired
+	}
+
+	op := m.newOperation()
+	op.journal = false
+	m.rollbackTo(op, pos)
+	op.calcVertexes()
+
+	m.checkInvariants()
+	op.changes = op.changeSet()
+	op.flushEvents()
+	return op.changes, nil
+}
+
+func (m *Map) clearJournal() {
+	m.journalBase = m.journalPos()
+	m.journal = nil
+	m.steps = nil
+}
+
+func (m *Map) journalPos() int {
+	return m.journalBase + len(m.journal)
+}
+
+func (m *Map) rollbackTo(op *operation, pos int) {
+	for m.journalPos() > pos {
+		i := len(m.journal) - 1
+		undo := m.journal[i]
+		m.journal[i] = nil
+		m.journal = m.journal[:i]
+		undo(op)
+	}
+
+	for len(m.steps) > 0 && m.steps[len(m.steps)-1] >= pos {
+		m.steps = m.steps[:len(m.steps)-1]
+	}
+}
+
+// trimJournal 丢弃超出保留数量的最早的变更
+func (m *Map) trimJournal() {
+	for len(m.steps) > m.journalLimit {
+		next := m.journalPos()
+		if len(m.steps) > 1 {
+			next = m.steps[1]
+		}
+
+		cut := next - m.journalBase
+		for i := 0; i < cut; i++ {
+			m.journal[i] = nil
+		}
+		m.journal = m.journal[cut:]
+		m.journalBase = next
+		m.steps = m.steps[1:]
+	}
+}
+
+func (op *operation) record(undo undoFunc) {
+	if op.journal {
+		op.m.journal = append(op.m.journal, undo)
+	}
+	if op.rollback != nil {
+		op.rollback = append(op.rollback, undo)
+	}
+}
+
+// rollbackAll 用undo撤销op已做的所有修改，并丢弃其写入撤销日志的记录
+func (op *operation) rollbackAll(undo *operation) {
+	for i := len(op.rollback) - 1; i >= 0; i-- {
+		op.rollback[i](undo)
+		op.rollback[i] = nil
+	}
+	op.rollback = op.rollback[:0]
+
+	m := op.m
+	keep := op.mark - m.journalBase
+	if keep < 0 {
+		keep = 0
+	}
+	for i := keep; i < len(m.journal); i++ {
+		m.journal[i] = nil
+	}
+	m.journal = m.journal[:keep]
+}
+
+// commit 一次变更结束，其记录作为一步可撤销的变更
+func (op *operation) commit() {
+	m := op.m
+	if m.journalPos() > op.mark {
+		m.steps = append(m.steps, op.mark)
+	}
+	m.trimJournal()
+}
+
+func (op *operation) setLastFlagId(id int32) {
+	m := op.m
+	prev := m.lastFlagId
+	m.lastFlagId = id
+	op.record(func(op *operation) {
+		m.lastFlagId = prev
+	})
+}
+
+func (op *operation) setLastMTime(tm time.Time) {
+	m := op.m
+	prev := m.lastMTime
+	m.lastMTime = tm
+	op.record(func(op *operation) {
+		m.lastMTime = prev
+	})
+}
+
+func (op *operation) setReleased(flag *Flag, released bool) {
+	prev := flag.Released
+	flag.Released = released
+	op.record(func(op *operation) {
+		flag.Released = prev
+	})
+}
+
+func (op *operation) setMTime(flag *Flag, tm time.Time) {
+	prev := flag.MTime
+	flag.MTime = tm
+	op.record(func(op *operation) {
+		flag.MTime = prev
+	})
+}
+
+// setFlagTile 移动旗子，只能在旗子不在地图上时调用
+func (op *operation) setFlagTile(flag *Flag, tile *Tile) {
+	prev := flag.Tile
+	flag.Tile = tile
+	op.record(func(op *operation) {
+		flag.Tile = prev
+	})
+}
+
+func (op *operation) addOverlap(f *Flag, of *Flag) {
+	if f == of || f.Overlaps[of] == of {
+		return
+	}
+
+	f.AddOverlap(of)
+	op.record(func(op *operation) {
+		f.RemoveOverlap(of)
+	})
+}
+
+func (op *operation) removeOverlap(f *Flag, of *Flag) {
+	if f.Overlaps[of] == nil {
+		return
+	}
+
+	f.RemoveOverlap(of)
+	op.record(func(op *operation) {
+		f.AddOverlap(of)
+	})
+}
@@ -0,0 +1,171 @@
+package logic
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dumpState 把地图的全部状态按确定的顺序写成文本，用于逐字比较
+func dumpState(m *Map) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "last %d %d resolver %p policy %d\n", m.lastFlagId, m.lastMTime.UnixNano(), m.resolver, m.invalidPolicy)
+
+	ids := func(flags map[*Flag]*Flag) []int32 {
+		var list []int32
+		for f := range flags {
+			list = append(list, f.ID)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		return list
+	}
+
+	for _, f := range m.sortedFlags() {
+		fmt.Fprintf(&b, "flag %d at %v valid %v released %v invalidAt %d tiles %d\n",
+			f.ID, f.Tile.Vector2, f.IsValid, f.Released, f.InvalidAt.UnixNano(), f.Bitmap.Count())
+		fmt.Fprintf(&b, "  neighbors %v overlaps %v anchor %v\n", ids(f.Neighbors), ids(f.Overlaps), m.fortresses[f.AllianceId][f] == f)
+
+		var vertexes []string
+		for x, row := range f.Vertexes {
+			for y, code := range row {
+				vertexes = append(vertexes, fmt.Sprintf("%d:%d=%d", x, y, code))
+			}
+		}
+		sort.Strings(vertexes)
+		fmt.Fprintf(&b, "  vertexes %v\n", vertexes)
+	}
+
+	var tiles []string
+	for pos, id := range ownership(m) {
+		tiles = append(tiles, fmt.Sprintf("%d:%d=%d", pos.X, pos.Y, id))
+	}
+	sort.Strings(tiles)
+	fmt.Fprintf(&b, "tiles %v\n", tiles)
+
+	var terrain []string
+	for x, row := range m.terrain {
+		for y, t := range row {
+			terrain = append(terrain, fmt.Sprintf("%d:%d=%d", x, y, t))
+		}
+	}
+	sort.Strings(terrain)
+	fmt.Fprintf(&b, "terrain %v\n", terrain)
+
+	var index []string
+	for key, flags := range m.index {
+		index = append(index, fmt.Sprintf("%v=%v", key, ids(flags)))
+	}
+	sort.Strings(index)
+	fmt.Fprintf(&b, "index %v\n", index)
+
+	return b.String()
+}
+
+// randomStep 随机执行一次变更
+func randomStep(rnd *rand.Rand, m *Map, flags []*Flag) []*Flag {
+	switch n := rnd.Intn(10); {
+	case n < 5:
+		typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+		tm := time.Unix(int64(rnd.Intn(50)), 0)
+		if f, _, err := m.AddFlag(rnd.Int31n(40), rnd.Int31n(40), rnd.Int31n(3)+1, typeId, tm); err == nil {
+			flags = append(flags, f)
+		}
+	case n < 7 && len(flags) > 0:
+		i := rnd.Intn(len(flags))
+		m.RemoveFlag(flags[i])
+		flags = append(flags[:i:i], flags[i+1:]...)
+	case n < 8:
+		m.SetTerrain(rnd.Int31n(40), rnd.Int31n(40), Terrain(rnd.Intn(int(TerrainHill)+1)))
+	case n < 9:
+		m.Batch(func(tx *Tx) error {
+			flags = batchOps(rnd, tx, flags, 4)
+			return nil
+		})
+	default:
+		resolvers := []ConflictResolver{ResolveEarliest, ResolveNearest, ResolveStrongest}
+		m.SetConflictResolver(resolvers[rnd.Intn(len(resolvers))])
+	}
+	return flags
+}
+
+func TestUndoRestoresEveryStep(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m := NewMap()
+		m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+
+		var flags []*Flag
+		var states []string
+		for i := 0; i < 20; i++ {
+			steps, state := len(m.steps), dumpState(m)
+			flags = randomStep(rnd, m, flags)
+			if len(m.steps) > steps {
+				states = append(states, state)
+			}
+		}
+
+		for i := len(states) - 1; i >= 0; i-- {
+			if m.Undo() == nil {
+				t.Fatalf("seed %d: nothing to undo at step %d", seed, i)
+			}
+			if got := dumpState(m); got != states[i] {
+				t.Fatalf("seed %d: undo of step %d:\n%s\nwant:\n%s", seed, i, got, states[i])
+			}
+			if violations := m.Validate(); len(violations) > 0 {
+				t.Fatalf("seed %d: undo of step %d: %v", seed, i, violations[0])
+			}
+		}
+
+		if m.Undo() != nil {
+			t.Fatalf("seed %d: undo on an empty journal", seed)
+		}
+	}
+}
+
+func TestRollbackToMark(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	m, flags := randomMap(rnd, ResolveEarliest, 10)
+	m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	mark := m.Mark()
+	want := dumpState(m)
+
+	for i := 0; i < 30; i++ {
+		flags = randomStep(rnd, m, flags)
+	}
+
+	cs, err := m.RollbackTo(mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpState(m); got != want {
+		t.Fatalf("state after rollback:\n%s\nwant:\n%s", got, want)
+	}
+	if violations := m.Validate(); len(violations) > 0 {
+		t.Fatal(violations[0])
+	}
+	if cs == nil {
+		t.Fatal("no change set from rollback")
+	}
+}
+
+func TestJournalLimit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	m := NewMap()
+	m.SetJournalLimit(2)
+	mark := m.Mark()
+
+	var flags []*Flag
+	for len(flags) < 4 {
+		flags = randomStep(rnd, m, flags)
+	}
+
+	if _, err := m.RollbackTo(mark); err != ErrMarkExpired {
+		t.Fatalf("RollbackTo expired mark = %v, want ErrMarkExpired", err)
+	}
+	if len(m.steps) != 2 {
+		t.Fatalf("%d steps kept, want 2", len(m.steps))
+	}
+}
@@ -1,12 +1,13 @@
 package logic
 
 import (
-	"errors"
-	"fmt"
+	"runtime"
 	"sort"
+	"sync"
 	"time"
 )
 
+// FlagHalfLength 旗子默认的占领半径
 const FlagHalfLength int32 = 7
 
 type Vector2 struct {
@@ -47,76 +48,111 @@ type VertexType struct {
 	Code         int          //类型编码
 }
 
+// Tile 地块的视图，归属保存在地图的地块存储中；旗子自身的Tile不在地图上，直接记录归属
 type Tile struct {
 	Vector2
+	m         *Map
 	ownerFlag *Flag
 }
 
 func (t *Tile) GetAllianceId() int32 {
-	if t.ownerFlag == nil {
+	owner := t.OwnerFlag()
+	if owner == nil {
 		return 0
 	}
 
-	return t.ownerFlag.AllianceId
+	return owner.AllianceId
 }
 
 func (t *Tile) SetOwnerFlag(flag *Flag) {
+	if t.m != nil {
+		t.m.setOwnerAt(t.X, t.Y, flag)
+		return
+	}
+
+	if t.ownerFlag != nil && t.ownerFlag != flag {
+		t.ownerFlag.ClearTileBit(t)
+	}
 	t.ownerFlag = flag
 	flag.SetTileBit(t)
 }
 
 func (t *Tile) OwnerFlag() *Flag {
+	if t.m != nil {
+		return t.m.ownerAt(t.X, t.Y)
+	}
 	return t.ownerFlag
 }
 
 func (t *Tile) IsValid() bool {
-	return t.ownerFlag != nil && t.ownerFlag.IsValid
+	owner := t.OwnerFlag()
+	return owner != nil && owner.IsValid
 }
 
 func (t *Tile) IsFlag() bool {
-	return t.ownerFlag.Tile == t
+	owner := t.OwnerFlag()
+	return owner != nil && owner.Tile.Vector2 == t.Vector2
 }
 
 func (t *Tile) IsVertex() (bool, int) {
-	return t.ownerFlag.IsVertex(t.X, t.Y)
+	return t.OwnerFlag().IsVertex(t.X, t.Y)
 }
 
 func (t *Tile) IsEmpty() bool {
 	//todo: 临时的
-	return t.ownerFlag.Tile != t
+	return !t.IsFlag()
 }
 
 type Flag struct {
 	ID         int32
 	AllianceId int32
 	Tile       *Tile
-	IsFortress bool
+	Type       *FlagType
+	Radius     int32 //占领半径
+	Shape      Shape //占领形状
+	Budget     int32 //按地形消耗扩张时的总预算，0表示不限
 	Map        *Map
 	IsValid    bool
+	Released   bool            //失效超过宽限期后已放弃领地
+	InvalidAt  time.Time       //失效的时间
 	Neighbors  map[*Flag]*Flag //同盟的相邻旗子
 	Overlaps   map[*Flag]*Flag //相交叠的旗子
-	Bitmap     []int16
+	Bitmap     *Bitmap
 	Vertexes   map[int32]map[int32]int //联盟领地顶点
 	MTime      time.Time
+	slot       uint32 //在地块存储中的编号，没有领地时为0
 }
 
-func NewFlag(x int32, y int32, allianceId int32, isFortress bool, mp *Map, mtime time.Time) *Flag {
-	t, _ := mp.GetTile(x, y, true)
+// NewFlag 创建旗子，此时还未放到地图上
+func NewFlag(x int32, y int32, allianceId int32, flagType *FlagType, mp *Map, mtime time.Time) *Flag {
+	t := &Tile{
+		Vector2: Vector2{
+			x,
+			y,
+		},
+	}
 
 	f := &Flag{
 		AllianceId: allianceId,
 		Tile:       t,
-		IsFortress: isFortress,
+		Type:       flagType,
+		Radius:     flagType.Radius,
+		Shape:      flagType.Shape,
+		Budget:     flagType.Budget,
 		Map:        mp,
 		Neighbors:  make(map[*Flag]*Flag),
 		Overlaps:   make(map[*Flag]*Flag),
-		Bitmap:     make([]int16, FlagHalfLength*2+1, FlagHalfLength*2+1),
+		Bitmap:     NewBitmap(flagType.Radius),
 		MTime:      mtime,
 	}
-	t.SetOwnerFlag(f)
+	t.ownerFlag = f
 	return f
 }
 
+func (f *Flag) IsAnchor() bool {
+	return f.Type.IsAnchor
+}
+
 func (f *Flag) AddNeighbor(nf *Flag) {
 	if f == nf || f.Neighbors[nf] == nf {
 		return
@@ -135,9 +171,17 @@ func (f *Flag) RemoveNeighbor(nf *Flag) {
 }
 
 func (f *Flag) SetTileBit(tile *Tile) {
-	r := tile.Y - f.Tile.Y + FlagHalfLength
-	c := tile.X - f.Tile.X + FlagHalfLength
-	f.Bitmap[r] |= 1 << uint(c)
+	f.Bitmap.Set(tile.X-f.Tile.X, tile.Y-f.Tile.Y)
+}
+
+func (f *Flag) ClearTileBit(tile *Tile) {
+	f.Bitmap.Clear(tile.X-f.Tile.X, tile.Y-f.Tile.Y)
+}
+
+// InArea 判断坐标是否在旗子的占领范围内；形状超出位图的部分不算在内，以免写到位图之外
+func (f *Flag) InArea(x int32, y int32) bool {
+	dx, dy := x-f.Tile.X, y-f.Tile.Y
+	return f.Bitmap.Contains(dx, dy) && f.Shape.Contains(dx, dy, f.Radius)
 }
 
 func (f *Flag) ResetVertex() {
@@ -156,8 +200,6 @@ func (f *Flag) SetVertex(x int32, y int32, code int) {
 	}
 
 	row[y] = code
-
-	fmt.Printf("Vertex: %d - %d:%d = %d\n", f.AllianceId, x, y, code)
 }
 
 func (f *Flag) IsVertex(x int32, y int32) (bool, int) {
@@ -170,27 +212,33 @@ func (f *Flag) IsVertex(x int32, y int32) (bool, int) {
 	return ok, code
 }
 
+// CalcVertexes 重算顶点。Vertexes及其各行原地清空后复用，顶点所在的行不变时不分配内存
 func (f *Flag) CalcVertexes() {
-	f.ResetVertex()
+	if f.Vertexes == nil {
+		f.ResetVertex()
+	}
+	for _, row := range f.Vertexes {
+		for y := range row {
+			delete(row, y)
+		}
+	}
 
 	m := f.Map
-	for j, bitmap := range f.Bitmap {
-		if bitmap == 0 {
-			continue
+	m.rlockShared()
+	defer m.runlockShared()
+
+	f.Bitmap.Each(func(dx int32, dy int32) {
+		x := f.Tile.X + dx
+		y := f.Tile.Y + dy
+		code := vertexCodes[m.tiles.surroundMask(x, y)]
+		if code != 0 {
+			f.SetVertex(x, y, code)
 		}
+	})
 
-		for i := int32(0); i <= 2*FlagHalfLength; i++ {
-			if (bitmap>>uint(i))&1 == 0 {
-				continue
-			}
-
-			x := i + f.Tile.X - FlagHalfLength
-			y := int32(j) + f.Tile.Y - FlagHalfLength
-			tile, _ := m.GetTile(x, y, false)
-			code := m.CalcVertexCode(tile)
-			if code != 0 {
-				f.SetVertex(x, y, code)
-			}
+	for x, row := range f.Vertexes {
+		if len(row) == 0 {
+			delete(f.Vertexes, x)
 		}
 	}
 }
@@ -214,7 +262,11 @@ func (f *Flag) RemoveOverlap(of *Flag) {
 }
 
 func (f *Flag) GetTiles() []*Tile {
-	return nil
+	tiles := make([]*Tile, 0, f.Bitmap.Count())
+	f.Bitmap.Each(func(dx int32, dy int32) {
+		tiles = append(tiles, &Tile{Vector2{f.Tile.X + dx, f.Tile.Y + dy}, f.Map, nil})
+	})
+	return tiles
 }
 
 type Vertex struct {
@@ -224,115 +276,181 @@ type Vertex struct {
 }
 
 type Map struct {
-	tiles      map[int32]map[int32]*Tile
+	tiles      *tileStore
 	fortresses map[int32]map[*Flag]*Flag
 	flags      map[int32]map[*Flag]*Flag
+	terrain    map[int32]map[int32]Terrain
+	index      map[cellKey]map[*Flag]*Flag
+	resolver   ConflictResolver
+	lastFlagId int32
+	lastMTime  time.Time
+
+	journal      []undoFunc //撤销日志，按修改顺序记录
+	journalBase  int        //已丢弃的日志条数
+	steps        []int      //每次变更开始时日志的位置
+	journalLimit int
+
+	listeners      []listenerEntry
+	lastListenerId int
+	bufferEvents   bool
+
+	invalidPolicy InvalidPolicy
+	gracePeriod   time.Duration
+	clock         func() time.Time
+	vertexWorkers int
+
+	shared *sync.RWMutex //非nil时多个goroutine可以同时修改互不相交的区域，保护tiles、flags和索引本身，见ShardedMap
 }
 
 func NewMap() *Map {
 	return &Map{
-		tiles:      make(map[int32]map[int32]*Tile),
+		tiles:      newTileStore(),
 		flags:      make(map[int32]map[*Flag]*Flag),
 		fortresses: make(map[int32]map[*Flag]*Flag),
+		terrain:    make(map[int32]map[int32]Terrain),
+		index:      make(map[cellKey]map[*Flag]*Flag),
+		resolver:   ResolveEarliest,
+		clock:      time.Now,
+
+		journalLimit:  DefaultJournalLimit,
+		vertexWorkers: runtime.GOMAXPROCS(0),
 	}
 }
 
+// GetTile 返回地块的视图，地块有主时exists为true；无主且不要求创建时返回nil
 func (m *Map) GetTile(x int32, y int32, createIfAbsent bool) (*Tile, bool) {
-	row, ok := m.tiles[x]
-	if row == nil {
-		if !createIfAbsent {
-			return nil, false
-		}
-
-		row = make(map[int32]*Tile)
-		m.tiles[x] = row
+	owner := m.ownerAt(x, y)
+	if owner == nil && !createIfAbsent {
+		return nil, false
 	}
 
-	t, ok := row[y]
-	if t == nil && createIfAbsent {
-		t = &Tile{
-			Vector2: Vector2{
-				x,
-				y,
-			},
-		}
+	return &Tile{Vector2{x, y}, m, nil}, owner != nil
+}
 
-		row[y] = t
-	}
+func (m *Map) CalcVertexCode(t *Tile) int {
+	return m.vertexCodeAt(t.X, t.Y)
+}
 
-	return t, ok
+func (m *Map) vertexCodeAt(x int32, y int32) int {
+	m.rlockShared()
+	defer m.runlockShared()
+	return vertexCodes[m.tiles.surroundMask(x, y)]
 }
 
-func (m *Map) removeTile(x int32, y int32) (*Tile, bool) {
-	row, ok := m.tiles[x]
-	if !ok {
-		return nil, ok
-	}
+// vertexCodes 周围8个地块的同盟掩码到顶点编码的映射，掩码第i位对应Orientations[i]
+var vertexCodes [256]int
+
+// buildVertexCodes 外顶点要求背后和左侧都不是同盟，内顶点要求前方和右后方是同盟而右前方不是
+func buildVertexCodes() {
+	for mask := range vertexCodes {
+		surround := func(o *Orientation) bool {
+			return mask&(1<<uint(o.Code)) != 0
+		}
 
-	t, ok := row[y]
-	if !ok {
-		return nil, ok
+		code := 0
+		for subCode, vertexType := range VertexTypes {
+			var orientation = vertexType.Orientation
+			if vertexType.IsOuter {
+				if !surround(orientation.Back()) && !surround(orientation.Left()) {
+					code |= subCode
+				}
+			} else {
+				if surround(orientation) && !surround(orientation.rotate(-1)) && surround(orientation.rotate(-2)) {
+					code |= subCode
+				}
+			}
+		}
+		vertexCodes[mask] = code
 	}
+}
 
-	if len(row) == 1 {
-		delete(m.tiles, x)
-	} else {
-		delete(row, y)
+// AddFlag 放置旗子并返回这次变更的结果，不能放置时返回*PlacementError
+func (m *Map) AddFlag(x int32, y int32, allianceId int32, typeId int32, tm time.Time) (*Flag, *ChangeSet, error) {
+	op := m.newOperation()
+	f, err := m.newFlag(op, x, y, allianceId, typeId, tm)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return t, ok
+	m.insertStep(op, f)
+	op.finish()
+
+	return f, op.changes, nil
 }
 
-func (m *Map) CalcVertexCode(t *Tile) int {
-	surround := make([]bool, 8, 8)
-	for i, o := range Orientations {
-		x := t.X + o.X
-		y := t.Y + o.Y
-
-		tile, ex := m.GetTile(x, y, false)
-		if ex && tile.GetAllianceId() == t.GetAllianceId() {
-			surround[i] = true
-		} else {
-			surround[i] = false
-		}
+// newFlag 检查能否放置并创建分配了ID的旗子，此时还未放到地图上
+func (m *Map) newFlag(op *operation, x int32, y int32, allianceId int32, typeId int32, tm time.Time) (*Flag, error) {
+	if err := m.CanPlaceFlag(x, y, allianceId, typeId); err != nil {
+		return nil, err
 	}
 
-	code := 0
-	for subCode, vertexType := range VertexTypes {
-		var orientation = vertexType.Orientation
-		if vertexType.IsOuter {
-			if !surround[orientation.Back().Code] && !surround[orientation.Left().Code] {
-				code |= subCode
-			}
-		} else {
-			if surround[orientation.Code] && !surround[orientation.rotate(-1).Code] && surround[orientation.rotate(-2).Code] {
-				code |= subCode
-			}
-		}
-	}
+	m.lockShared()
+	op.setLastFlagId(m.lastFlagId + 1)
+	id := m.lastFlagId
+	m.unlockShared()
 
-	return code
+	f := NewFlag(x, y, allianceId, GetFlagType(typeId), m, tm)
+	f.ID = id
+	f.InvalidAt = m.clock()
+	return f, nil
 }
 
-func (m *Map) AddFlag(x int32, y int32, allianceId int32, isFortress bool, tm time.Time) (*Flag, error) {
-	t, ex := m.GetTile(x, y, false)
+// insertStep 把旗子放到地图上；不是最后放置的旗子时需要重放之后放置的旗子
+func (m *Map) insertStep(op *operation, f *Flag) {
+	m.rlockShared()
+	latest := !f.MTime.Before(m.lastMTime) && f.ID == m.lastFlagId
+	m.runlockShared()
 
-	if ex {
-		if t.GetAllianceId() != allianceId {
-			return nil, errors.New("not yours")
-		}
+	if latest {
+		m.addStep(op, f)
+	} else {
+		m.replay(op, m.affectedFlags(f))
+	}
 
-		if !t.IsEmpty() {
-			return nil, errors.New("occupied")
-		}
+	m.lockShared()
+	if f.MTime.After(m.lastMTime) {
+		op.setLastMTime(f.MTime)
 	}
+	m.unlockShared()
+}
 
-	if !isFortress && !m.checkFlagSettable(x, y, allianceId) {
-		return nil, errors.New("no neighbor")
+// placeFlag 登记旗子、占领旗子所在地块并扩张领地
+func (m *Map) placeFlag(op *operation, f *Flag) {
+	if !m.hasFlag(f) {
+		m.registerFlag(op, f)
 	}
 
-	f := NewFlag(x, y, allianceId, isFortress, m, tm)
+	if f.IsAnchor() {
+		op.setValid(f, true)
+	}
 
+	// 旗子总是占据所在地块，这不算作争夺
+	op.setOwner(f.Tile.X, f.Tile.Y, f)
+	op.stolen = make(map[*Flag]*Flag)
+	op.touchAlliance(f.AllianceId)
+
+	m.scanFlagArea(op, f)
+}
+
+func (m *Map) hasFlag(f *Flag) bool {
+	return m.allianceFlags(f.AllianceId)[f] == f
+}
+
+// allianceFlags 联盟的旗子；并发修改时只有持有该联盟的锁才能读取
+func (m *Map) allianceFlags(allianceId int32) map[*Flag]*Flag {
+	m.rlockShared()
+	defer m.runlockShared()
+	return m.flags[allianceId]
+}
+
+func (m *Map) allianceFortresses(allianceId int32) map[*Flag]*Flag {
+	m.rlockShared()
+	defer m.runlockShared()
+	return m.fortresses[allianceId]
+}
+
+func (m *Map) registerFlag(op *operation, f *Flag) {
+	m.lockShared()
 	flags := m.flags[f.AllianceId]
 	if flags == nil {
 		flags = make(map[*Flag]*Flag)
@@ -340,8 +458,9 @@ func (m *Map) AddFlag(x int32, y int32, allianceId int32, isFortress bool, tm ti
 	}
 
 	flags[f] = f
+	m.indexFlag(f)
 
-	if isFortress {
+	if f.IsAnchor() {
 		fortresses := m.fortresses[f.AllianceId]
 
 		if fortresses == nil {
@@ -350,79 +469,106 @@ func (m *Map) AddFlag(x int32, y int32, allianceId int32, isFortress bool, tm ti
 		}
 
 		fortresses[f] = f
-		f.IsValid = true
-	}
-
-	m.scanFlagArea(f)
-
-	f.CalcVertexes()
-	for neighbor := range f.Neighbors {
-		neighbor.CalcVertexes()
 	}
+	m.unlockShared()
 
-	m.scanAllianceArea(allianceId)
-
-	return f, nil
+	op.emit(Event{Type: EventFlagAdded, X: f.Tile.X, Y: f.Tile.Y, Flag: f})
+	op.record(func(op *operation) {
+		m.unregisterFlag(op, f)
+	})
 }
 
-func (m *Map) RemoveFlag(flag *Flag) {
+func (m *Map) unregisterFlag(op *operation, flag *Flag) {
+	m.lockShared()
+	m.unindexFlag(flag)
 	delete(m.flags[flag.AllianceId], flag)
 	if len(m.flags[flag.AllianceId]) == 0 {
 		delete(m.flags, flag.AllianceId)
 	}
-	if flag.IsFortress {
+	if flag.IsAnchor() {
 		delete(m.fortresses[flag.AllianceId], flag)
 		if len(m.fortresses[flag.AllianceId]) == 0 {
 			delete(m.fortresses, flag.AllianceId)
 		}
 	}
+	m.unlockShared()
 
-	for i := -FlagHalfLength; i <= FlagHalfLength; i++ {
-		x := flag.Tile.X + i
-		for j := -FlagHalfLength; j <= FlagHalfLength; j++ {
-			y := flag.Tile.Y + j
-			tile, ex := m.GetTile(x, y, false)
-			if ex && tile.OwnerFlag() == flag {
-				m.removeTile(x, y)
-			}
-		}
-	}
+	op.emit(Event{Type: EventFlagRemoved, X: flag.Tile.X, Y: flag.Tile.Y, Flag: flag})
+	op.record(func(op *operation) {
+		m.registerFlag(op, flag)
+	})
+}
+
+// RemoveFlag 移除旗子并返回这次变更的结果，之后放置且与其范围传递相交的旗子会重放，结果与从未放置过该旗子一致
+func (m *Map) RemoveFlag(flag *Flag) *ChangeSet {
+	op := m.newOperation()
+	m.removeStep(op, flag)
+	op.finish()
+
+	return op.changes
+}
+
+// removeStep 把旗子从地图上移除，并重放受其影响的旗子
+func (m *Map) removeStep(op *operation, flag *Flag) {
+	affected := m.affectedFlags(flag)
+	delete(affected, flag)
+
+	m.unregisterFlag(op, flag)
 
-	vertexDirty := make(map[*Flag]*Flag)
+	flag.Bitmap.Each(func(dx int32, dy int32) {
+		op.releaseTile(flag.Tile.X+dx, flag.Tile.Y+dy)
+	})
 
 	for neighbor := range flag.Neighbors {
-		neighbor.RemoveNeighbor(flag)
-		vertexDirty[neighbor] = neighbor
+		op.unlink(neighbor, flag)
 	}
-	allianceIds := make(map[int32]int32)
+	op.touchAlliance(flag.AllianceId)
 
-	sorter := &OverlapSorter{
-		Flags: make([]*Flag, 0, len(flag.Overlaps)),
+	for overlap := range flag.Overlaps {
+		op.removeOverlap(overlap, flag)
 	}
-	sorter.AddAll(flag.Overlaps)
-	sort.Sort(sorter)
 
-	for _, overlap := range sorter.Flags {
-		overlap.RemoveOverlap(flag)
-		m.scanFlagArea(overlap)
-		allianceIds[overlap.AllianceId] = overlap.AllianceId
-		vertexDirty[overlap] = overlap
-	}
+	m.replay(op, affected)
+}
 
-	for _, f1 := range vertexDirty {
-		f1.CalcVertexes()
-	}
+// maxRepartitionPasses 防止不满足全序的ConflictResolver导致地块来回易主
+const maxRepartitionPasses = 64
+
+// repartition 按放置时间依次让旗子重新扩张；有地块被夺走时，失主及其重叠的旗子在下一轮重新扩张，
+// 直到一轮中没有地块易主
+func (m *Map) repartition(op *operation, flags map[*Flag]*Flag) {
+	pending := flags
+	for pass := 0; len(pending) > 0 && pass < maxRepartitionPasses; pass++ {
+		sorter := &OverlapSorter{
+			Flags: make([]*Flag, 0, len(pending)),
+		}
+		for f := range pending {
+			if m.hasFlag(f) {
+				sorter.Flags = append(sorter.Flags, f)
+			}
+		}
+		sort.Sort(sorter)
+
+		op.stolen = make(map[*Flag]*Flag)
+		for _, f := range sorter.Flags {
+			m.scanFlagArea(op, f)
+			op.touchAlliance(f.AllianceId)
+		}
 
-	for allianceId := range allianceIds {
-		m.scanAllianceArea(allianceId)
+		pending = make(map[*Flag]*Flag)
+		for victim := range op.stolen {
+			pending[victim] = victim
+			for overlap := range victim.Overlaps {
+				pending[overlap] = overlap
+			}
+		}
 	}
 }
 
-func (m *Map) checkFlagSettable(x int32, y int32, allianceId int32) bool {
-	minX := x - FlagHalfLength
-	maxX := x + FlagHalfLength
-	minY := y - FlagHalfLength
-	maxY := y + FlagHalfLength
+func (m *Map) checkFlagSettable(x int32, y int32, allianceId int32, flagType *FlagType) bool {
+	if flagType.Budget > 0 {
+		return m.checkFlagSettableByCost(x, y, allianceId, flagType)
+	}
 
 	type TileListNode struct {
 		X    int32
@@ -438,16 +584,16 @@ func (m *Map) checkFlagSettable(x int32, y int32, allianceId int32) bool {
 
 	marked := make(map[int32]map[int32]bool)
 
-	scan := func(x int32, y int32) bool {
-		tile, ex := m.GetTile(x, y, false)
-		if ex && tile.GetAllianceId() == allianceId {
+	scan := func(nx int32, ny int32) bool {
+		owner := m.ownerAt(nx, ny)
+		if owner != nil && owner.AllianceId == allianceId {
 			return true
 		}
 
-		if m.markCoordinate(marked, x, y) && !ex && x >= minX && x <= maxX && y >= minY && y <= maxY {
+		if m.markCoordinate(marked, nx, ny) && owner == nil && flagType.inArea(nx-x, ny-y) && !m.isBlocked(nx, ny) {
 			next := &TileListNode{
-				X: x,
-				Y: y,
+				X: nx,
+				Y: ny,
 			}
 			tail.Next = next
 			tail = next
@@ -459,19 +605,7 @@ func (m *Map) checkFlagSettable(x int32, y int32, allianceId int32) bool {
 	m.markCoordinate(marked, x, y)
 
 	for head != nil {
-		if head.X >= minX && scan(head.X-1, head.Y) {
-			return true
-		}
-
-		if head.X <= maxX && scan(head.X+1, head.Y) {
-			return true
-		}
-
-		if head.Y >= minY && scan(head.X, head.Y-1) {
-			return true
-		}
-
-		if head.Y <= maxY && scan(head.X, head.Y+1) {
+		if scan(head.X-1, head.Y) || scan(head.X+1, head.Y) || scan(head.X, head.Y-1) || scan(head.X, head.Y+1) {
 			return true
 		}
 
@@ -481,21 +615,34 @@ func (m *Map) checkFlagSettable(x int32, y int32, allianceId int32) bool {
 	return false
 }
 
-func (m *Map) scanFlagArea(flag *Flag) {
+func (m *Map) scanFlagArea(op *operation, flag *Flag) {
+	if flag.Released {
+		return
+	}
+
+	m.floodFlagArea(flag, func(x int32, y int32) bool {
+		return m.claimTile(op, flag, x, y)
+	})
+}
+
+// floodFlagArea 从旗子所在地块出发遍历占领范围内的地块，claim返回false时不再经由该地块扩张；自身不修改地图
+func (m *Map) floodFlagArea(flag *Flag, claim func(x int32, y int32) bool) {
+	if flag.Budget > 0 {
+		m.floodFlagAreaByCost(flag, claim)
+		return
+	}
+
 	t := flag.Tile
-	x, y := t.X, t.Y
-	minX := x - FlagHalfLength
-	maxX := x + FlagHalfLength
-	minY := y - FlagHalfLength
-	maxY := y + FlagHalfLength
 
 	type TileListNode struct {
-		Tile *Tile
+		X    int32
+		Y    int32
 		Next *TileListNode
 	}
 
 	head := &TileListNode{
-		Tile: t,
+		X: t.X,
+		Y: t.Y,
 	}
 	tail := head
 
@@ -506,67 +653,94 @@ func (m *Map) scanFlagArea(flag *Flag) {
 			return
 		}
 
-		tile, ex := m.GetTile(x, y, true)
-		if ex {
-			flag.AddOverlap(tile.OwnerFlag())
-
-			if tile.GetAllianceId() != flag.AllianceId {
-				return
-			}
-
-			flag.AddNeighbor(tile.OwnerFlag())
-		} else {
-			tile.SetOwnerFlag(flag)
+		if !claim(x, y) {
+			return
 		}
 
 		next := &TileListNode{
-			Tile: tile,
+			X: x,
+			Y: y,
 		}
 		tail.Next = next
 		tail = next
 	}
 
-	checkNeighbor := func(x int32, y int32) bool {
-		tile, ex := m.GetTile(x, y, false)
-		if ex && tile.GetAllianceId() == flag.AllianceId {
-			flag.AddNeighbor(tile.OwnerFlag())
-			return true
+	visit := func(x int32, y int32) {
+		if flag.InArea(x, y) && !m.isBlocked(x, y) {
+			scan(x, y)
 		}
-
-		return false
 	}
 
-	m.markCoordinate(marked, x, y)
+	m.markCoordinate(marked, t.X, t.Y)
 	for head != nil {
-		tile := head.Tile
+		visit(head.X-1, head.Y)
+		visit(head.X+1, head.Y)
+		visit(head.X, head.Y-1)
+		visit(head.X, head.Y+1)
 
-		if tile.X > minX {
-			scan(tile.X-1, tile.Y)
-		} else if tile.X == minX {
-			checkNeighbor(tile.X-1, tile.Y)
-		}
+		head = head.Next
+	}
+}
 
-		if tile.X < maxX {
-			scan(tile.X+1, tile.Y)
-		} else if tile.X == maxX {
-			checkNeighbor(tile.X+1, tile.Y)
-		}
+// claimTile 占领空地块，或由ConflictResolver决定重叠地块的归属，返回是否可以经由该地块继续扩张
+func (m *Map) claimTile(op *operation, flag *Flag, x int32, y int32) bool {
+	holder := m.ownerAt(x, y)
+	if holder == nil {
+		op.setOwner(x, y, flag)
+		return true
+	}
+	if holder == flag {
+		return true
+	}
+
+	op.addOverlap(flag, holder)
+
+	// 只有争夺时才需要Tile交给ConflictResolver
+	isFlag := holder.Tile.X == x && holder.Tile.Y == y
+	if !isFlag && m.prefer(&Tile{Vector2{x, y}, m, nil}, flag, holder) {
+		op.setOwner(x, y, flag)
+		return true
+	}
 
-		if tile.Y > minY {
-			scan(tile.X, tile.Y-1)
-		} else if tile.Y == minY {
-			checkNeighbor(tile.X, tile.Y-1)
+	return holder.AllianceId == flag.AllianceId
+}
+
+// relinkNeighbors 按地块相邻关系重建领地变化过的旗子的Neighbors：同盟旗子的地块上下左右相邻即为相邻旗子
+func (m *Map) relinkNeighbors(op *operation) {
+	dirty := op.linkDirty
+	op.linkDirty = make(map[*Flag]*Flag)
+
+	for f := range dirty {
+		if !m.hasFlag(f) {
+			continue
 		}
 
-		if tile.Y < maxY {
-			scan(tile.X, tile.Y+1)
-		} else if tile.Y == maxY {
-			checkNeighbor(tile.X, tile.Y+1)
+		neighbors := make(map[*Flag]*Flag)
+		f.Bitmap.Each(func(dx int32, dy int32) {
+			x, y := f.Tile.X+dx, f.Tile.Y+dy
+			for i := E; i <= N; i += 2 {
+				o := Orientations[i]
+				owner := m.ownerAt(x+o.X, y+o.Y)
+				if owner != nil && owner != f && owner.AllianceId == f.AllianceId {
+					neighbors[owner] = owner
+				}
+			}
+		})
+
+		for neighbor := range f.Neighbors {
+			if neighbors[neighbor] == nil {
+				op.unlink(f, neighbor)
+				op.touchAlliance(f.AllianceId)
+			}
 		}
 
-		head = head.Next
+		for neighbor := range neighbors {
+			if f.Neighbors[neighbor] == nil {
+				op.link(f, neighbor)
+				op.touchAlliance(f.AllianceId)
+			}
+		}
 	}
-
 }
 
 func (m *Map) markCoordinate(marked map[int32]map[int32]bool, x int32, y int32) bool {
@@ -584,7 +758,7 @@ func (m *Map) markCoordinate(marked map[int32]map[int32]bool, x int32, y int32)
 	return !exists
 }
 
-func (m *Map) scanAllianceArea(allianceId int32) {
+func (m *Map) scanAllianceArea(op *operation, allianceId int32) {
 	type FlagListNode struct {
 		Flag *Flag
 		Next *FlagListNode
@@ -592,7 +766,7 @@ func (m *Map) scanAllianceArea(allianceId int32) {
 
 	marked := make(map[*Flag]*Flag)
 
-	for flag := range m.fortresses[allianceId] {
+	for flag := range m.allianceFortresses(allianceId) {
 		if marked[flag] == flag {
 			continue
 		}
@@ -618,14 +792,14 @@ func (m *Map) scanAllianceArea(allianceId int32) {
 				tail = next
 			}
 
-			f.IsValid = true
+			op.setValid(f, true)
 			head = head.Next
 		}
 	}
 
-	for flag := range m.flags[allianceId] {
+	for flag := range m.allianceFlags(allianceId) {
 		if marked[flag] == nil {
-			flag.IsValid = false
+			op.setValid(flag, false)
 		}
 	}
 }
@@ -645,7 +819,7 @@ func (f *OverlapSorter) Len() int {
 }
 
 func (f *OverlapSorter) Less(i, j int) bool {
-	return f.Flags[i].MTime.UnixNano() < f.Flags[j].MTime.UnixNano()
+	return compareEarliest(nil, f.Flags[i], f.Flags[j]) < 0
 }
 
 func (f *OverlapSorter) Swap(i, j int) {
@@ -0,0 +1,188 @@
+package logic
+
+import (
+	"sort"
+	"time"
+)
+
+// operation 记录一次变更中受影响的旗子和联盟，结束时统一重算顶点和连通性
+type operation struct {
+	m           *Map
+	vertexDirty map[*Flag]*Flag
+	linkDirty   map[*Flag]*Flag //需要重建Neighbors的旗子
+	alliances   map[int32]int32
+	stolen      map[*Flag]*Flag   //被夺走地块的旗子
+	flipped     map[*Flag]*Flag   //有效性发生变化的旗子
+	origins     map[Vector2]*Flag //地块变更前的归属
+	validity    map[*Flag]bool    //旗子变更前的有效性
+	changes     *ChangeSet        //finish之后的净结果
+	events      []Event           //缓存待派发的事件
+	silent      bool              //不发出事件
+	buffered    bool              //无论地图如何设置都缓存事件
+	journal     bool              //是否记录到撤销日志
+	unchecked   bool              //地块来自外部输入，由调用者检查不变量，finish时不断言
+	rollback    []undoFunc        //不为nil时另外记下本次变更的撤销，供批量变更失败时回滚，与撤销日志无关
+	mark        int               //开始时日志的位置
+}
+
+func (m *Map) newOperation() *operation {
+	return &operation{
+		m:           m,
+		vertexDirty: make(map[*Flag]*Flag),
+		linkDirty:   make(map[*Flag]*Flag),
+		alliances:   make(map[int32]int32),
+		stolen:      make(map[*Flag]*Flag),
+		flipped:     make(map[*Flag]*Flag),
+		origins:     make(map[Vector2]*Flag),
+		validity:    make(map[*Flag]bool),
+		journal:     m.journalLimit > 0,
+		mark:        m.journalPos(),
+	}
+}
+
+func (op *operation) setOwner(x int32, y int32, flag *Flag) {
+	prev := op.m.ownerAt(x, y)
+	if prev == flag {
+		return
+	}
+
+	if prev != nil {
+		op.stolen[prev] = prev
+		op.touchVertex(prev)
+	}
+
+	op.rememberOwner(x, y, prev)
+	op.m.setOwnerAt(x, y, flag)
+	op.touchSurround(x, y)
+	op.emit(Event{Type: EventTileOwnerChanged, X: x, Y: y, Flag: flag, Other: prev})
+
+	op.record(func(op *operation) {
+		op.restoreOwner(x, y, prev)
+	})
+}
+
+// releaseTile 把地块还原为无主
+func (op *operation) releaseTile(x int32, y int32) {
+	owner := op.m.ownerAt(x, y)
+	if owner == nil {
+		return
+	}
+
+	op.rememberOwner(x, y, owner)
+	op.m.setOwnerAt(x, y, nil)
+	op.touchVertex(owner)
+	op.touchSurround(x, y)
+	op.emit(Event{Type: EventTileOwnerChanged, X: x, Y: y, Other: owner})
+
+	op.record(func(op *operation) {
+		op.restoreOwner(x, y, owner)
+	})
+}
+
+// restoreOwner 撤销时把地块的归属恢复为owner，nil为无主
+func (op *operation) restoreOwner(x int32, y int32, owner *Flag) {
+	if owner != nil {
+		op.setOwner(x, y, owner)
+	} else {
+		op.releaseTile(x, y)
+	}
+}
+
+// touchSurround 地块归属变化会影响其自身及周围8个地块的顶点编码和相邻关系
+func (op *operation) touchSurround(x int32, y int32) {
+	op.touchVertex(op.m.ownerAt(x, y))
+	for _, o := range Orientations {
+		op.touchVertex(op.m.ownerAt(x+o.X, y+o.Y))
+	}
+}
+
+func (op *operation) touchVertex(flag *Flag) {
+	if flag != nil {
+		op.vertexDirty[flag] = flag
+		op.linkDirty[flag] = flag
+	}
+}
+
+func (op *operation) touchAlliance(allianceId int32) {
+	op.alliances[allianceId] = allianceId
+}
+
+func (op *operation) setValid(flag *Flag, valid bool) {
+	if flag.IsValid == valid {
+		return
+	}
+
+	op.rememberValid(flag)
+	invalidAt := flag.InvalidAt
+	op.record(func(op *operation) {
+		op.setValid(flag, !valid)
+		flag.InvalidAt = invalidAt
+	})
+
+	flag.IsValid = valid
+	if valid {
+		flag.InvalidAt = time.Time{}
+	} else {
+		flag.InvalidAt = op.m.clock()
+	}
+	op.flipped[flag] = flag
+	op.emit(Event{Type: EventFlagValidityChanged, X: flag.Tile.X, Y: flag.Tile.Y, Flag: flag, Valid: valid})
+}
+
+func (op *operation) link(f *Flag, neighbor *Flag) {
+	f.AddNeighbor(neighbor)
+	op.emit(Event{Type: EventNeighborLinked, Flag: f, Other: neighbor})
+	op.record(func(op *operation) {
+		op.unlink(f, neighbor)
+	})
+}
+
+func (op *operation) unlink(f *Flag, neighbor *Flag) {
+	f.RemoveNeighbor(neighbor)
+	op.emit(Event{Type: EventNeighborUnlinked, Flag: f, Other: neighbor})
+	op.record(func(op *operation) {
+		op.link(f, neighbor)
+	})
+}
+
+func (op *operation) finish() {
+	m := op.m
+	for pass := 0; (len(op.alliances) > 0 || len(op.linkDirty) > 0) && pass < maxRepartitionPasses; pass++ {
+		m.relinkNeighbors(op)
+
+		alliances := op.alliances
+		op.alliances = make(map[int32]int32)
+		op.flipped = make(map[*Flag]*Flag)
+
+		for allianceId := range alliances {
+			m.scanAllianceArea(op, allianceId)
+		}
+
+		m.resolveValidity(op)
+	}
+
+	// 地块归属已不再变化，顶点可以并行重算
+	op.calcVertexes()
+
+	// 并发修改时其他区域可能正处于变更中途
+	if m.shared == nil && !op.unchecked {
+		m.checkInvariants()
+	}
+	op.commit()
+
+	op.changes = op.changeSet()
+	op.flushEvents()
+}
+
+// calcVertexes 重算地块归属变化过的旗子的顶点。顶点只取决于地块归属，撤销日志不记录顶点，撤销后同样按此重算
+func (op *operation) calcVertexes() {
+	m := op.m
+	sorter := &OverlapSorter{}
+	for flag := range op.vertexDirty {
+		if m.hasFlag(flag) {
+			sorter.Flags = append(sorter.Flags, flag)
+		}
+	}
+	sort.Sort(sorter)
+	m.calcVertexes(sorter.Flags)
+}
@@ -23,6 +23,13 @@ const (
 	NE = 7
 )
 
+const (
+	FlagTypeOutpost    = 1
+	FlagTypeWatchtower = 2
+	FlagTypeFortress   = 3
+	FlagTypeCapital    = 4
+)
+
 const (
 	VertexOuterNW = 1
 	VertexOuterNE = 1 << 1
@@ -102,6 +109,29 @@ func init() {
 		Code:         VertexInnerSW,
 		ExpectedCode: VertexOuterSW | VertexInnerSE,
 	}
+	buildVertexCodes()
+
+	for _, ft := range []*FlagType{
+		{ID: FlagTypeOutpost, Name: "outpost", Radius: 4, Shape: ShapeDiamond, Priority: 0},
+		{ID: FlagTypeWatchtower, Name: "watchtower", Radius: FlagHalfLength, Priority: 1},
+		{ID: FlagTypeFortress, Name: "fortress", Radius: FlagHalfLength, IsAnchor: true, Priority: 2, Standalone: true},
+		{ID: FlagTypeCapital, Name: "capital", Radius: 10, Shape: ShapeCircle, IsAnchor: true, Priority: 3, Standalone: true},
+	} {
+		if err := RegisterFlagType(ft); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, tt := range []*TerrainType{
+		{Terrain: TerrainPlain, Name: "plain", Cost: 1},
+		{Terrain: TerrainWater, Name: "water", Blocking: true},
+		{Terrain: TerrainMountain, Name: "mountain", Blocking: true},
+		{Terrain: TerrainImpassable, Name: "impassable", Blocking: true},
+		{Terrain: TerrainForest, Name: "forest", Cost: 2},
+		{Terrain: TerrainHill, Name: "hill", Cost: 3},
+	} {
+		TerrainTypes[tt.Terrain] = tt
+	}
 }
 
 var Orientations []*Orientation
@@ -0,0 +1,202 @@
+package logic
+
+import "sort"
+
+// Preview PreviewAddFlag的结果
+type Preview struct {
+	Flag         *Flag     //将要放置的旗子，未放到地图上
+	Gained       []Vector2 //无主、将被占领的地块
+	Won          []Vector2 //将从其他旗子手中夺得的地块
+	Contested    []Vector2 //与其他旗子重叠但仍归对方的地块
+	Overlaps     []*Flag   //将与之重叠的旗子
+	Losers       []*Flag   //将被夺走地块的旗子
+	Neighbors    []*Flag   //将与之相邻的同盟旗子
+	Valid        bool      //放置后自身是否与要塞连通
+	Reconnected  []*Flag   //将因此恢复连通的同盟旗子
+	Disconnected []*Flag   //将因失去地块而与要塞断开连通的旗子，可能属于其他联盟
+}
+
+// PreviewAddFlag 模拟在当前所有旗子之后放置旗子，返回它的扩张结果，以及失主失去地块后各联盟的连通性；不会修改地图。
+// 先到先得时结果与AddFlag一致。其他策略下不包含失主随后重新划分的结果，
+// 也不包含InvalidYield、InvalidRelease下有效性变化引起的重放
+func (m *Map) PreviewAddFlag(x int32, y int32, allianceId int32, typeId int32) (*Preview, error) {
+	if err := m.CanPlaceFlag(x, y, allianceId, typeId); err != nil {
+		return nil, err
+	}
+
+	m.rlockShared()
+	tm := m.clock()
+	if tm.Before(m.lastMTime) {
+		tm = m.lastMTime
+	}
+	id := m.lastFlagId + 1
+	m.runlockShared()
+
+	f := NewFlag(x, y, allianceId, GetFlagType(typeId), m, tm)
+	f.ID = id
+	f.IsValid = f.IsAnchor()
+
+	p := &Preview{
+		Flag: f,
+	}
+
+	claimed := map[Vector2]bool{f.Tile.Vector2: true}
+	overlaps := make(map[*Flag]*Flag)
+	losers := make(map[*Flag]*Flag)
+	if holder := m.ownerAt(x, y); holder != nil {
+		losers[holder] = holder
+		p.Won = append(p.Won, f.Tile.Vector2)
+	} else {
+		p.Gained = append(p.Gained, f.Tile.Vector2)
+	}
+
+	m.floodFlagArea(f, func(x int32, y int32) bool {
+		pos := Vector2{x, y}
+		holder := m.ownerAt(x, y)
+		if holder == nil {
+			claimed[pos] = true
+			p.Gained = append(p.Gained, pos)
+			return true
+		}
+
+		overlaps[holder] = holder
+
+		tile := &Tile{pos, m, nil}
+		if !tile.IsFlag() && m.prefer(tile, f, holder) {
+			claimed[pos] = true
+			losers[holder] = holder
+			p.Won = append(p.Won, pos)
+			return true
+		}
+
+		p.Contested = append(p.Contested, pos)
+		return holder.AllianceId == f.AllianceId
+	})
+
+	// 放置后的地块归属：夺得的地块归f，其余不变
+	ownerAfter := func(x int32, y int32) *Flag {
+		if claimed[Vector2{x, y}] {
+			return f
+		}
+		return m.ownerAt(x, y)
+	}
+	adjacent := func(flag *Flag, x int32, y int32, links map[*Flag]*Flag) {
+		for i := E; i <= N; i += 2 {
+			o := Orientations[i]
+			if owner := ownerAfter(x+o.X, y+o.Y); owner != nil && owner != flag && owner.AllianceId == flag.AllianceId {
+				links[owner] = owner
+			}
+		}
+	}
+
+	// 重新计算f和失主的相邻关系，其他旗子的相邻关系只会因它们而变化
+	relinked := make(map[*Flag]map[*Flag]*Flag)
+	neighbors := make(map[*Flag]*Flag)
+	for pos := range claimed {
+		adjacent(f, pos.X, pos.Y, neighbors)
+	}
+	relinked[f] = neighbors
+	alliances := map[int32]int32{allianceId: allianceId}
+	for loser := range losers {
+		links := make(map[*Flag]*Flag)
+		loser.Bitmap.Each(func(dx int32, dy int32) {
+			x, y := loser.Tile.X+dx, loser.Tile.Y+dy
+			if !claimed[Vector2{x, y}] {
+				adjacent(loser, x, y, links)
+			}
+		})
+		relinked[loser] = links
+		alliances[loser.AllianceId] = loser.AllianceId
+	}
+
+	reconnected := make(map[*Flag]*Flag)
+	disconnected := make(map[*Flag]*Flag)
+	for id := range alliances {
+		reachable := m.previewReachable(id, f, relinked)
+		if id == allianceId {
+			p.Valid = reachable[f] != nil
+		}
+		for flag := range m.allianceFlags(id) {
+			switch {
+			case !flag.IsValid && reachable[flag] != nil:
+				reconnected[flag] = flag
+			case flag.IsValid && reachable[flag] == nil:
+				disconnected[flag] = flag
+			}
+		}
+	}
+
+	sortVectors(p.Gained)
+	sortVectors(p.Won)
+	sortVectors(p.Contested)
+	p.Overlaps = sortFlags(overlaps)
+	p.Losers = sortFlags(losers)
+	p.Neighbors = sortFlags(neighbors)
+	p.Reconnected = sortFlags(reconnected)
+	p.Disconnected = sortFlags(disconnected)
+
+	return p, nil
+}
+
+// previewReachable 与scanAllianceArea相同的遍历，relinked中的旗子使用重新计算的相邻关系，
+// 其余旗子在已有的相邻关系上随之增减；f属于该联盟时一并参与
+func (m *Map) previewReachable(allianceId int32, f *Flag, relinked map[*Flag]map[*Flag]*Flag) map[*Flag]*Flag {
+	linked := func(flag *Flag) map[*Flag]*Flag {
+		if links, ok := relinked[flag]; ok {
+			return links
+		}
+
+		links := make(map[*Flag]*Flag, len(flag.Neighbors)+1)
+		for n := range flag.Neighbors {
+			if changed, ok := relinked[n]; !ok || changed[flag] != nil {
+				links[n] = n
+			}
+		}
+		if relinked[f][flag] != nil {
+			links[f] = f
+		}
+		return links
+	}
+
+	var queue []*Flag
+	marked := make(map[*Flag]*Flag)
+	for flag := range m.allianceFortresses(allianceId) {
+		queue = append(queue, flag)
+		marked[flag] = flag
+	}
+	if f.AllianceId == allianceId && f.IsAnchor() {
+		queue = append(queue, f)
+		marked[f] = f
+	}
+
+	for len(queue) > 0 {
+		flag := queue[0]
+		queue = queue[1:]
+		for n := range linked(flag) {
+			if marked[n] == nil {
+				marked[n] = n
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	return marked
+}
+
+func sortFlags(flags map[*Flag]*Flag) []*Flag {
+	sorter := &OverlapSorter{
+		Flags: make([]*Flag, 0, len(flags)),
+	}
+	sorter.AddAll(flags)
+	sort.Sort(sorter)
+	return sorter.Flags
+}
+
+func sortVectors(vs []Vector2) {
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].X != vs[j].X {
+			return vs[i].X < vs[j].X
+		}
+		return vs[i].Y < vs[j].Y
+	})
+}
@@ -0,0 +1,51 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+// 联盟2的要塞(0, 0)经由前哨(10, 0)连到瞭望塔(19, 0)；按优先级裁决时，
+// 联盟1在(10, 6)放置的主城夺走前哨除旗子所在地块外的全部领地，前哨和瞭望塔都与要塞断开
+func TestPreviewDisconnectsLosers(t *testing.T) {
+	m := NewMap()
+	m.SetConflictResolver(ResolveStrongest)
+	add := func(x int32, y int32, allianceId int32, typeId int32, mtime int64) *Flag {
+		f, _, err := m.AddFlag(x, y, allianceId, typeId, time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	fortress := add(0, 0, 2, FlagTypeFortress, 0)
+	outpost := add(10, 0, 2, FlagTypeOutpost, 1)
+	tower := add(19, 0, 2, FlagTypeWatchtower, 2)
+	if !outpost.IsValid || !tower.IsValid {
+		t.Fatal("alliance 2 is not connected before the capital")
+	}
+
+	before := make(map[int32]bool)
+	for _, flag := range m.sortedFlags() {
+		before[flag.ID] = flag.IsValid
+	}
+	p, err := m.PreviewAddFlag(10, 6, 1, FlagTypeCapital)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Losers) != 3 || p.Losers[0] != fortress || p.Losers[1] != outpost || p.Losers[2] != tower {
+		t.Fatalf("losers = %v", p.Losers)
+	}
+	if len(p.Disconnected) != 2 || p.Disconnected[0] != outpost || p.Disconnected[1] != tower {
+		t.Fatalf("disconnected = %v", p.Disconnected)
+	}
+
+	capital := add(10, 6, 1, FlagTypeCapital, 3)
+	if err := comparePreview(p, capital, before); err != nil {
+		t.Fatal(err)
+	}
+	for _, pos := range p.Won {
+		if owner := m.ownerAt(pos.X, pos.Y); owner != capital {
+			t.Fatalf("%d:%d owned by %v, want the capital", pos.X, pos.Y, owner)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FlagSpec 重建地图所需的旗子信息，其余状态都可以由这些信息推导
+type FlagSpec struct {
+	ID         int32     `json:"id"`
+	AllianceId int32     `json:"alliance"`
+	X          int32     `json:"x"`
+	Y          int32     `json:"y"`
+	TypeId     int32     `json:"type"`
+	MTime      time.Time `json:"mtime"`
+	Released   bool      `json:"released,omitempty"`
+}
+
+func (f *Flag) Spec() FlagSpec {
+	return FlagSpec{
+		ID:         f.ID,
+		AllianceId: f.AllianceId,
+		X:          f.Tile.X,
+		Y:          f.Tile.Y,
+		TypeId:     f.Type.ID,
+		MTime:      f.MTime,
+		Released:   f.Released,
+	}
+}
+
+// NewMapFromFlags 按放置顺序依次放置旗子构建地图，ID为0的旗子会分配新ID。
+// 每面旗子放置前按CanPlaceFlag检查，不能放置时返回*PlacementError，其Spec为该旗子在specs中的下标
+func NewMapFromFlags(specs []FlagSpec) (*Map, error) {
+	m := NewMap()
+	flags, err := m.specFlags(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(flags))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareEarliest(nil, flags[order[i]], flags[order[j]]) < 0
+	})
+
+	op := m.newOperation()
+	op.journal = false
+	op.silent = true
+	for _, i := range order {
+		f := flags[i]
+		if err := m.CanPlaceFlag(f.Tile.X, f.Tile.Y, f.AllianceId, f.Type.ID); err != nil {
+			pe := err.(*PlacementError)
+			pe.Spec = i
+			return nil, pe
+		}
+		m.addStep(op, f)
+	}
+	op.finish()
+
+	return m, nil
+}
+
+// FlagSpecs 按放置顺序返回所有旗子
+func (m *Map) FlagSpecs() []FlagSpec {
+	flags := m.sortedFlags()
+	specs := make([]FlagSpec, 0, len(flags))
+	for _, f := range flags {
+		specs = append(specs, f.Spec())
+	}
+	return specs
+}
+
+// Rebuild 丢弃所有推导出的状态，按放置顺序重新放置所有旗子；不发出事件，监听者需要自行全量刷新
+func (m *Map) Rebuild() {
+	op := m.newOperation()
+	m.rebuild(op)
+	op.finish()
+}
+
+// derivedState 重建前旗子上推导出的状态，撤销重建时整体换回
+type derivedState struct {
+	neighbors map[*Flag]*Flag
+	overlaps  map[*Flag]*Flag
+	bitmap    *Bitmap
+	vertexes  map[int32]map[int32]int
+	valid     bool
+	released  bool
+	invalidAt time.Time
+	slot      uint32
+}
+
+func (m *Map) rebuild(op *operation) {
+	flags := m.sortedFlags()
+
+	tiles, registered, fortresses, index := m.tiles, m.flags, m.fortresses, m.index
+	states := make(map[*Flag]derivedState, len(flags))
+	for _, f := range flags {
+		states[f] = derivedState{f.Neighbors, f.Overlaps, f.Bitmap, f.Vertexes, f.IsValid, f.Released, f.InvalidAt, f.slot}
+	}
+	op.record(func(op *operation) {
+		m.tiles, m.flags, m.fortresses, m.index = tiles, registered, fortresses, index
+		for f, s := range states {
+			f.Neighbors, f.Overlaps, f.Bitmap, f.Vertexes = s.neighbors, s.overlaps, s.bitmap, s.vertexes
+			f.IsValid, f.Released, f.InvalidAt, f.slot = s.valid, s.released, s.invalidAt, s.slot
+		}
+	})
+
+	// 之后的修改都由上面整体撤销
+	op.journal = false
+	op.silent = true
+
+	m.tiles = newTileStore()
+	m.flags = make(map[int32]map[*Flag]*Flag)
+	m.fortresses = make(map[int32]map[*Flag]*Flag)
+	m.index = make(map[cellKey]map[*Flag]*Flag)
+
+	for _, f := range flags {
+		f.Neighbors = make(map[*Flag]*Flag)
+		f.Overlaps = make(map[*Flag]*Flag)
+		f.Bitmap = NewBitmap(f.Radius)
+		f.ResetVertex()
+		// 重建后仍然失效的旗子从此刻开始计算宽限期，已经失效的保留原来的时间
+		if f.IsValid {
+			f.InvalidAt = m.clock()
+		}
+		f.IsValid = false
+		f.slot = 0
+	}
+
+	for _, f := range flags {
+		m.addStep(op, f)
+	}
+}
+
+func (m *Map) sortedFlags() []*Flag {
+	sorter := &OverlapSorter{}
+	for _, flags := range m.flags {
+		sorter.AddAll(flags)
+	}
+	sort.Sort(sorter)
+	return sorter.Flags
+}
+
+// addSpecs 登记旗子但不占领领地，之后需要Rebuild
+func (m *Map) addSpecs(specs []FlagSpec) error {
+	flags, err := m.specFlags(specs)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range flags {
+		registered := m.flags[f.AllianceId]
+		if registered == nil {
+			registered = make(map[*Flag]*Flag)
+			m.flags[f.AllianceId] = registered
+		}
+		registered[f] = f
+	}
+	return nil
+}
+
+// specFlags 按specs创建旗子，顺序与specs一致；此时还未登记到地图上。
+// 旗子在阻挡地形上或与之前的旗子在同一地块时返回*PlacementError
+func (m *Map) specFlags(specs []FlagSpec) ([]*Flag, error) {
+	ids := make(map[int32]bool, len(specs))
+	for _, spec := range specs {
+		if spec.ID != 0 {
+			if ids[spec.ID] {
+				return nil, fmt.Errorf("duplicate flag id %d", spec.ID)
+			}
+			ids[spec.ID] = true
+		}
+
+		if spec.ID > m.lastFlagId {
+			m.lastFlagId = spec.ID
+		}
+	}
+
+	flags := make([]*Flag, 0, len(specs))
+	positions := make(map[Vector2]*Flag, len(specs))
+	for i, spec := range specs {
+		flagType := GetFlagType(spec.TypeId)
+		if flagType == nil {
+			return nil, fmt.Errorf("flag %d: unknown flag type %d", spec.ID, spec.TypeId)
+		}
+
+		// 与放置顺序无关的检查
+		var pe *PlacementError
+		pos := Vector2{spec.X, spec.Y}
+		if m.isBlocked(spec.X, spec.Y) {
+			pe = m.placementError(ErrBlocked, spec.X, spec.Y, spec.AllianceId, spec.TypeId, nil)
+		} else if other := positions[pos]; other != nil {
+			pe = m.placementError(ErrOccupied, spec.X, spec.Y, spec.AllianceId, spec.TypeId, other)
+		}
+		if pe != nil {
+			pe.Spec = i
+			return nil, pe
+		}
+
+		f := NewFlag(spec.X, spec.Y, spec.AllianceId, flagType, m, spec.MTime)
+		f.ID = spec.ID
+		if f.ID == 0 {
+			m.lastFlagId++
+			f.ID = m.lastFlagId
+		}
+		f.Released = spec.Released
+		flags = append(flags, f)
+		positions[pos] = f
+
+		if f.MTime.After(m.lastMTime) {
+			m.lastMTime = f.MTime
+		}
+	}
+
+	return flags, nil
+}
@@ -0,0 +1,118 @@
+package logic
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func spec(id int32, x int32, y int32, allianceId int32, typeId int32, mtime int64) FlagSpec {
+	return FlagSpec{ID: id, AllianceId: allianceId, X: x, Y: y, TypeId: typeId, MTime: time.Unix(mtime, 0)}
+}
+
+func TestNewMapFromFlags(t *testing.T) {
+	specs := []FlagSpec{
+		spec(3, 12, 0, 1, FlagTypeOutpost, 2),
+		spec(1, 0, 0, 1, FlagTypeFortress, 0),
+		spec(2, 20, 0, 2, FlagTypeFortress, 1),
+	}
+	m, err := NewMapFromFlags(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameAsReference(t, m, referenceMap(m, nil), "from flags")
+	if len(m.FlagSpecs()) != 3 || m.lastFlagId != 3 || !m.flagById(3).IsValid {
+		t.Fatalf("%d flags, last id %d", len(m.FlagSpecs()), m.lastFlagId)
+	}
+}
+
+// 按放置顺序不能放置的旗子返回*PlacementError，Spec为它在specs中的下标
+func TestNewMapFromFlagsRejectsIllegalSpecs(t *testing.T) {
+	cases := []struct {
+		name  string
+		specs []FlagSpec
+		err   error
+		index int
+	}{
+		{
+			name:  "same tile",
+			specs: []FlagSpec{spec(1, 0, 0, 1, FlagTypeFortress, 0), spec(2, 0, 0, 1, FlagTypeFortress, 1)},
+			err:   ErrOccupied,
+			index: 1,
+		},
+		{
+			name:  "no anchor",
+			specs: []FlagSpec{spec(1, 0, 0, 1, FlagTypeOutpost, 0)},
+			err:   ErrNoNeighbor,
+			index: 0,
+		},
+		{
+			// 要塞晚于前哨放置，放置前哨时还没有可依附的领地
+			name:  "anchor placed later",
+			specs: []FlagSpec{spec(1, 0, 0, 1, FlagTypeFortress, 5), spec(2, 9, 0, 1, FlagTypeOutpost, 1)},
+			err:   ErrNoNeighbor,
+			index: 1,
+		},
+		{
+			name:  "enemy territory",
+			specs: []FlagSpec{spec(2, 3, 0, 2, FlagTypeFortress, 1), spec(1, 0, 0, 1, FlagTypeFortress, 0)},
+			err:   ErrNotYours,
+			index: 0,
+		},
+	}
+
+	for _, c := range cases {
+		m, err := NewMapFromFlags(c.specs)
+		var pe *PlacementError
+		if !errors.As(err, &pe) || pe.Err != c.err || pe.Spec != c.index || m != nil {
+			t.Errorf("%s: %v, want %v at spec %d", c.name, err, c.err, c.index)
+		}
+	}
+}
+
+// 快照中的旗子在阻挡地形上时拒绝读取
+func TestSnapshotRejectsFlagOnBlockedTerrain(t *testing.T) {
+	m := NewMap()
+	if _, _, err := m.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	s := m.Snapshot(false)
+	s.Terrain = append(s.Terrain, TerrainRecord{0, 0, TerrainWater})
+
+	_, err := NewMapFromSnapshot(s, false)
+	if !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("NewMapFromSnapshot = %v, want ErrBadSnapshot", err)
+	}
+}
+
+// 重建后才失效的旗子从重建时开始计算宽限期，到期后照常释放领地
+func TestRebuildStartsGracePeriod(t *testing.T) {
+	// randomMap放置旗子时使用真实时钟
+	now := time.Now()
+	cutOff := 0
+	for seed := int64(0); seed < 200; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, _ := randomMap(rnd, ResolveEarliest, 14)
+		m.SetClock(func() time.Time { return now })
+		m.SetInvalidPolicy(InvalidRelease, time.Minute)
+		before := validity(m)
+
+		m.SetConflictResolver(ResolveAnchorFirst)
+		m.Tick(now.Add(time.Hour))
+		for _, f := range m.sortedFlags() {
+			if f.IsValid {
+				continue
+			}
+			if before[f.ID] {
+				cutOff++
+			}
+			if !f.Released {
+				t.Fatalf("seed %d: flag %d invalid since %v but not released", seed, f.ID, f.InvalidAt)
+			}
+		}
+	}
+	if cutOff == 0 {
+		t.Fatal("no flag was cut off by the rebuild")
+	}
+}
@@ -0,0 +1,135 @@
+package logic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// referenceMap 用m中除without外的旗子、地形和裁决策略建立参照模型，不经过地图的增量逻辑
+func referenceMap(m *Map, without *Flag) *refModel {
+	ref := newRefModel()
+	ref.resolver = m.resolver
+	for x, row := range m.terrain {
+		for y, terrain := range row {
+			ref.terrain[Vector2{x, y}] = terrain
+		}
+	}
+
+	for i, spec := range m.FlagSpecs() {
+		if without == nil || spec.ID != without.ID {
+			ref.flags[i] = &refFlag{
+				ID:         spec.ID,
+				AllianceId: spec.AllianceId,
+				Pos:        Vector2{spec.X, spec.Y},
+				Type:       GetFlagType(spec.TypeId),
+				MTime:      spec.MTime.UnixNano(),
+			}
+		}
+	}
+
+	return ref
+}
+
+func ownership(m *Map) map[Vector2]int32 {
+	owners := make(map[Vector2]int32)
+	m.tiles.each(func(x int32, y int32, owner *Flag) {
+		owners[Vector2{x, y}] = owner.ID
+	})
+	return owners
+}
+
+func validity(m *Map) map[int32]bool {
+	valid := make(map[int32]bool)
+	for _, flags := range m.flags {
+		for f := range flags {
+			valid[f.ID] = f.IsValid
+		}
+	}
+	return valid
+}
+
+func assertSameAsReference(t *testing.T, m *Map, ref *refModel, context string) {
+	t.Helper()
+
+	if err := compareWithRef(m, ref); err != nil {
+		t.Fatalf("%s: %v", context, err)
+	}
+}
+
+var flagTypeIds = []int32{FlagTypeOutpost, FlagTypeWatchtower, FlagTypeFortress, FlagTypeCapital, flagTypeCamp}
+
+// randomMap 在40x40的范围内随机放置旗子，放置时间乱序
+func randomMap(rnd *rand.Rand, resolver ConflictResolver, attempts int) (*Map, []*Flag) {
+	m := NewMap()
+	m.SetConflictResolver(resolver)
+
+	for i := rnd.Intn(20); i > 0; i-- {
+		m.SetTerrain(rnd.Int31n(40), rnd.Int31n(40), Terrain(rnd.Intn(int(TerrainHill)+1)))
+	}
+
+	var flags []*Flag
+	for i := 0; i < attempts; i++ {
+		typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+		tm := time.Unix(int64(rnd.Intn(50)), 0)
+		f, _, err := m.AddFlag(rnd.Int31n(40), rnd.Int31n(40), rnd.Int31n(3)+1, typeId, tm)
+		if err == nil {
+			flags = append(flags, f)
+		}
+	}
+
+	return m, flags
+}
+
+func TestRemoveFlagMatchesRebuild(t *testing.T) {
+	resolvers := []ConflictResolver{ResolveEarliest, ResolveNearest, ResolveStrongest, ResolveAnchorFirst, ResolveValidFirst}
+	for _, resolver := range resolvers {
+		for seed := int64(0); seed < 40; seed++ {
+			rnd := rand.New(rand.NewSource(seed))
+			m, flags := randomMap(rnd, resolver, 12)
+			assertSameAsReference(t, m, referenceMap(m, nil), "after adds")
+
+			rnd.Shuffle(len(flags), func(i, j int) {
+				flags[i], flags[j] = flags[j], flags[i]
+			})
+			for _, f := range flags {
+				ref := referenceMap(m, f)
+				m.RemoveFlag(f)
+				assertSameAsReference(t, m, ref, "after remove")
+			}
+		}
+	}
+}
+
+// 联盟1的前哨经由本联盟主城的领地扩张到联盟3的主城够不到的地块；
+// 移除联盟1的主城后，联盟3的主城重新扩张，这些地块转给更早的它
+func TestRemoveFlagCascades(t *testing.T) {
+	m := NewMap()
+	m.SetConflictResolver(ResolveStrongest)
+
+	add := func(x int32, y int32, allianceId int32, typeId int32, mtime int64) *Flag {
+		f, _, err := m.AddFlag(x, y, allianceId, typeId, time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	capital := add(26, 14, 1, FlagTypeCapital, 0)
+	rival := add(16, 5, 3, FlagTypeCapital, 8)
+	outpost := add(14, 15, 1, FlagTypeOutpost, 19)
+
+	before := ownership(m)
+	ref := referenceMap(m, capital)
+	m.RemoveFlag(capital)
+	assertSameAsReference(t, m, ref, "after remove")
+
+	moved := 0
+	for pos, id := range before {
+		if id == outpost.ID && m.ownerAt(pos.X, pos.Y) == rival {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no tile moved from the outpost to the earlier capital")
+	}
+}
@@ -0,0 +1,88 @@
+package logic
+
+import "sort"
+
+// isOrdered 先到先得且领地不受有效性影响时，旗子的领地只取决于比它早放置的旗子
+func (m *Map) isOrdered() bool {
+	return m.resolver == ResolveEarliest && !m.validityMatters()
+}
+
+// affectedFlags 返回seeds变化后需要重放的旗子：seeds本身，以及影响范围与之传递相交的旗子。
+// 有序时早于所有待重放旗子的旗子不受影响，除非待重放的旗子落在它的领地上
+func (m *Map) affectedFlags(seeds ...*Flag) map[*Flag]*Flag {
+	var pivot *Flag
+	result := make(map[*Flag]*Flag, len(seeds))
+	for _, seed := range seeds {
+		result[seed] = seed
+		if pivot == nil || compareEarliest(nil, seed, pivot) < 0 {
+			pivot = seed
+		}
+	}
+
+	ordered := m.isOrdered()
+	for lowered := true; lowered; {
+		lowered = false
+
+		queue := make([]*Flag, 0, len(result))
+		for f := range result {
+			queue = append(queue, f)
+		}
+
+		for len(queue) > 0 {
+			f := queue[0]
+			queue = queue[1:]
+
+			for near := range m.flagsNear(f.Bounds()) {
+				if result[near] != nil {
+					continue
+				}
+
+				earlier := compareEarliest(nil, near, pivot) < 0
+				if ordered && earlier && !near.Bounds().Contains(f.Tile.X, f.Tile.Y) {
+					continue
+				}
+
+				result[near] = near
+				queue = append(queue, near)
+				if earlier {
+					pivot = near
+					lowered = true
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// replay 清空flags的领地后按放置顺序逐个重新放置，结果与从头依次放置所有旗子一致
+func (m *Map) replay(op *operation, flags map[*Flag]*Flag) {
+	sorter := &OverlapSorter{
+		Flags: make([]*Flag, 0, len(flags)),
+	}
+	sorter.AddAll(flags)
+	sort.Sort(sorter)
+
+	for _, f := range sorter.Flags {
+		f.Bitmap.Each(func(dx int32, dy int32) {
+			op.releaseTile(f.Tile.X+dx, f.Tile.Y+dy)
+		})
+
+		for overlap := range f.Overlaps {
+			op.removeOverlap(f, overlap)
+		}
+	}
+
+	for _, f := range sorter.Flags {
+		m.addStep(op, f)
+	}
+}
+
+// addStep 放置一面旗子；夺取了其他旗子的地块时重新划分受影响的区域
+func (m *Map) addStep(op *operation, f *Flag) {
+	op.stolen = make(map[*Flag]*Flag)
+	m.placeFlag(op, f)
+	if len(op.stolen) > 0 {
+		m.repartition(op, op.stolen)
+	}
+}
@@ -0,0 +1,117 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+// SafeMap 可以在多个goroutine中使用的地图：查询并行执行，变更依次执行。
+// 返回的旗子和ChangeSet中的旗子只能在View或Update中读取；监听者在写锁内被调用，不能再调用SafeMap
+type SafeMap struct {
+	mu sync.RWMutex
+	m  *Map
+}
+
+// TileInfo 地块在查询时的状态，之后的变更不会影响它
+type TileInfo struct {
+	Vector2
+	FlagId     int32 //所属旗子，无主为0
+	AllianceId int32
+	Valid      bool
+	IsFlag     bool //旗子所在地块
+}
+
+// NewSafeMap 包装m，之后只能通过SafeMap访问m；m为nil时新建地图
+func NewSafeMap(m *Map) *SafeMap {
+	if m == nil {
+		m = NewMap()
+	}
+	return &SafeMap{m: m}
+}
+
+// View 在读锁内执行fn，fn不能修改地图
+func (s *SafeMap) View(fn func(m *Map) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(s.m)
+}
+
+// Update 在写锁内执行fn
+func (s *SafeMap) Update(fn func(m *Map) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.m)
+}
+
+func (s *SafeMap) GetTile(x int32, y int32) (TileInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return tileInfo(s.m, x, y)
+}
+
+func tileInfo(m *Map, x int32, y int32) (TileInfo, bool) {
+	info := TileInfo{Vector2: Vector2{x, y}}
+	tile, ex := m.GetTile(x, y, false)
+	if !ex || tile.OwnerFlag() == nil {
+		return info, false
+	}
+
+	info.FlagId = tile.OwnerFlag().ID
+	info.AllianceId = tile.GetAllianceId()
+	info.Valid = tile.IsValid()
+	info.IsFlag = tile.IsFlag()
+	return info, true
+}
+
+// NewBoundarySeeker 返回的BoundarySeeker不再读取地图，可以在锁外使用
+func (s *SafeMap) NewBoundarySeeker(allianceId int32) *BoundarySeeker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return NewBoundarySeeker(s.m, allianceId)
+}
+
+func (s *SafeMap) CanPlaceFlag(x int32, y int32, allianceId int32, typeId int32) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.CanPlaceFlag(x, y, allianceId, typeId)
+}
+
+func (s *SafeMap) PreviewAddFlag(x int32, y int32, allianceId int32, typeId int32) (*Preview, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.PreviewAddFlag(x, y, allianceId, typeId)
+}
+
+func (s *SafeMap) AddFlag(x int32, y int32, allianceId int32, typeId int32, tm time.Time) (*Flag, *ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.AddFlag(x, y, allianceId, typeId, tm)
+}
+
+// RemoveFlag 旗子已被其他goroutine移除时返回ErrNotOnMap
+func (s *SafeMap) RemoveFlag(flag *Flag) (*ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.m.hasFlag(flag) {
+		return nil, ErrNotOnMap
+	}
+	return s.m.RemoveFlag(flag), nil
+}
+
+func (s *SafeMap) SetTerrain(x int32, y int32, terrain Terrain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.SetTerrain(x, y, terrain)
+}
+
+func (s *SafeMap) Tick(now time.Time) *ChangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.Tick(now)
+}
+
+func (s *SafeMap) Batch(fn func(tx *Tx) error) (*ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.Batch(fn)
+}
@@ -0,0 +1,91 @@
+package logic
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 用go test -race运行才能发现数据竞争
+func TestSafeMapConcurrentAccess(t *testing.T) {
+	s := NewSafeMap(nil)
+	if _, _, err := s.AddFlag(20, 20, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			var flags []*Flag
+			for i := 0; i < 60; i++ {
+				if rnd.Intn(3) > 0 || len(flags) == 0 {
+					typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+					f, _, err := s.AddFlag(rnd.Int31n(40), rnd.Int31n(40), rnd.Int31n(3)+1, typeId, time.Unix(int64(i), 0))
+					if err == nil {
+						flags = append(flags, f)
+					}
+					continue
+				}
+
+				j := rnd.Intn(len(flags))
+				if _, err := s.RemoveFlag(flags[j]); err != nil {
+					t.Error(err)
+				}
+				flags = append(flags[:j:j], flags[j+1:]...)
+			}
+		}(int64(w))
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				x, y := rnd.Int31n(40), rnd.Int31n(40)
+				if info, ok := s.GetTile(x, y); ok && (info.FlagId == 0 || info.AllianceId == 0) {
+					t.Errorf("tile %d:%d: owned tile without owner %+v", x, y, info)
+				}
+
+				if i%20 == 0 {
+					bs := s.NewBoundarySeeker(rnd.Int31n(3) + 1)
+					for n := 0; !bs.Finished() && n < 10000; n++ {
+						bs.Next()
+					}
+				}
+
+				if i%10 == 0 {
+					s.CanPlaceFlag(x, y, rnd.Int31n(3)+1, FlagTypeOutpost)
+				}
+			}
+		}(int64(100 + r))
+	}
+
+	wg.Wait()
+
+	s.View(func(m *Map) error {
+		if violations := m.Validate(); len(violations) > 0 {
+			t.Fatal(violations[0])
+		}
+		return nil
+	})
+}
+
+func TestSafeMapRemoveTwice(t *testing.T) {
+	s := NewSafeMap(nil)
+	f, _, err := s.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.RemoveFlag(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RemoveFlag(f); err != ErrNotOnMap {
+		t.Fatalf("second RemoveFlag = %v, want ErrNotOnMap", err)
+	}
+}
@@ -0,0 +1,91 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Shape 占领区域的形状，(dx, dy)为相对旗子的偏移，形状不能超出radius围成的正方形
+type Shape interface {
+	Contains(dx int32, dy int32, radius int32) bool
+}
+
+type squareShape struct{}
+
+func (squareShape) Contains(dx int32, dy int32, radius int32) bool {
+	return dx >= -radius && dx <= radius && dy >= -radius && dy <= radius
+}
+
+// 曼哈顿距离不超过radius的菱形
+type diamondShape struct{}
+
+func (diamondShape) Contains(dx int32, dy int32, radius int32) bool {
+	return abs32(dx)+abs32(dy) <= radius
+}
+
+// 欧几里得距离不超过radius的圆
+type circleShape struct{}
+
+func (circleShape) Contains(dx int32, dy int32, radius int32) bool {
+	return dx*dx+dy*dy <= radius*radius
+}
+
+var (
+	ShapeSquare  Shape = squareShape{}
+	ShapeDiamond Shape = diamondShape{}
+	ShapeCircle  Shape = circleShape{}
+)
+
+// Stencil 自定义的占领模板，半径由模板大小决定
+type Stencil struct {
+	mask *Bitmap
+}
+
+// NewStencil 由字符行构造模板，'#'为占领，'.'为不占领，行列数必须相等且为奇数，中心必须占领
+func NewStencil(rows []string) (*Stencil, error) {
+	side := len(rows)
+	if side%2 == 0 {
+		return nil, errors.New("stencil side must be odd")
+	}
+
+	radius := int32(side / 2)
+	mask := NewBitmap(radius)
+	for j, row := range rows {
+		if len(row) != side {
+			return nil, fmt.Errorf("stencil row %d: expected %d columns, got %d", j, side, len(row))
+		}
+
+		for i, c := range row {
+			switch c {
+			case '#':
+				mask.Set(int32(i)-radius, int32(j)-radius)
+			case '.':
+			default:
+				return nil, fmt.Errorf("stencil row %d: unexpected %q", j, c)
+			}
+		}
+	}
+
+	if !mask.Test(0, 0) {
+		return nil, errors.New("stencil center must be claimed")
+	}
+
+	return &Stencil{
+		mask: mask,
+	}, nil
+}
+
+func (s *Stencil) Radius() int32 {
+	return s.mask.Radius()
+}
+
+func (s *Stencil) Contains(dx int32, dy int32, radius int32) bool {
+	return s.mask.Test(dx, dy)
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
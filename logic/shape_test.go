@@ -0,0 +1,192 @@
+package logic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 十字形模板，半径1
+var crossRows = []string{
+	".#.",
+	"###",
+	".#.",
+}
+
+func mustStencil(t *testing.T, rows []string) *Stencil {
+	t.Helper()
+	st, err := NewStencil(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestShapeContains(t *testing.T) {
+	cross := mustStencil(t, crossRows)
+	cases := []struct {
+		name   string
+		shape  Shape
+		dx, dy int32
+		radius int32
+		want   bool
+	}{
+		{"square corner", ShapeSquare, 3, -3, 3, true},
+		{"square outside", ShapeSquare, 4, 0, 3, false},
+		{"diamond edge", ShapeDiamond, 2, -2, 4, true},
+		{"diamond corner", ShapeDiamond, 3, 2, 4, false},
+		{"diamond axis", ShapeDiamond, 0, -4, 4, true},
+		{"circle axis", ShapeCircle, 5, 0, 5, true},
+		{"circle inside", ShapeCircle, 3, 4, 5, true},
+		{"circle corner", ShapeCircle, 4, 4, 5, false},
+		{"stencil arm", cross, 0, 1, 1, true},
+		{"stencil corner", cross, 1, 1, 1, false},
+		// 模板只看自身大小，忽略传入的半径
+		{"stencil beyond mask", cross, 2, 0, 5, false},
+	}
+
+	for _, c := range cases {
+		if got := c.shape.Contains(c.dx, c.dy, c.radius); got != c.want {
+			t.Errorf("%s: Contains(%d, %d, %d) = %v, want %v", c.name, c.dx, c.dy, c.radius, got, c.want)
+		}
+	}
+}
+
+// 空地图上放置的旗子占满整个形状
+func TestShapeFootprint(t *testing.T) {
+	const (
+		typeDiamond = 200 + iota
+		typeCircle
+		typeStencil
+	)
+	for _, ft := range []*FlagType{
+		{ID: typeDiamond, Name: "test-diamond", Radius: 4, Shape: ShapeDiamond, Standalone: true},
+		{ID: typeCircle, Name: "test-circle", Radius: 3, Shape: ShapeCircle, Standalone: true},
+		{ID: typeStencil, Name: "test-stencil", Radius: 9, Shape: mustStencil(t, crossRows), Standalone: true},
+	} {
+		if err := RegisterFlagType(ft); err != nil {
+			t.Fatal(err)
+		}
+		defer delete(FlagTypes, ft.ID)
+	}
+
+	cases := []struct {
+		typeId int32
+		tiles  int
+		radius int32
+	}{
+		{typeDiamond, 2*4*4 + 2*4 + 1, 4},
+		{typeCircle, 29, 3},
+		// 模板的半径取代注册时给出的半径
+		{typeStencil, 5, 1},
+	}
+
+	for _, c := range cases {
+		m := NewMap()
+		f, _, err := m.AddFlag(0, 0, 1, c.typeId, time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := f.Bitmap.Count(); n != c.tiles || f.Radius != c.radius {
+			t.Errorf("%s: %d tiles with radius %d, want %d with radius %d", f.Type.Name, n, f.Radius, c.tiles, c.radius)
+		}
+		f.Bitmap.Each(func(dx int32, dy int32) {
+			if !f.Type.Shape.Contains(dx, dy, f.Radius) {
+				t.Errorf("%s: claimed %d:%d outside the shape", f.Type.Name, dx, dy)
+			}
+		})
+	}
+}
+
+// everywhere 不遵守约定的自定义形状
+type everywhere struct{}
+
+func (everywhere) Contains(dx int32, dy int32, radius int32) bool {
+	return true
+}
+
+// 形状超出半径围成的正方形的部分被忽略，不会写到位图之外
+func TestShapeClippedToRadius(t *testing.T) {
+	const (
+		typeEverywhere = 210 + iota
+		typeEverywhereBudget
+		typeEverywhereAttached
+	)
+	for _, ft := range []*FlagType{
+		{ID: typeEverywhere, Name: "test-everywhere", Radius: 2, Shape: everywhere{}, Standalone: true},
+		{ID: typeEverywhereBudget, Name: "test-everywhere-budget", Radius: 2, Shape: everywhere{}, Budget: 3, Standalone: true},
+		{ID: typeEverywhereAttached, Name: "test-everywhere-attached", Radius: 2, Shape: everywhere{}},
+	} {
+		if err := RegisterFlagType(ft); err != nil {
+			t.Fatal(err)
+		}
+		defer delete(FlagTypes, ft.ID)
+	}
+
+	cases := []struct {
+		typeId int32
+		tiles  int
+	}{
+		{typeEverywhere, 25},
+		// 预算能到达四个角以外的地块
+		{typeEverywhereBudget, 21},
+	}
+	for _, c := range cases {
+		m := NewMap()
+		f, _, err := m.AddFlag(0, 0, 1, c.typeId, time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := f.Bitmap.Count(); n != c.tiles {
+			t.Errorf("%s: %d tiles, want %d", f.Type.Name, n, c.tiles)
+		}
+		if violations := m.Validate(); len(violations) > 0 {
+			t.Errorf("%s: %v", f.Type.Name, violations[0])
+		}
+	}
+
+	// 寻找己方领地时同样不会越过半径
+	m := NewMap()
+	if _, _, err := m.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CanPlaceFlag(11, 0, 1, typeEverywhereAttached); !errors.Is(err, ErrNoNeighbor) {
+		t.Fatalf("CanPlaceFlag beyond the radius = %v, want ErrNoNeighbor", err)
+	}
+}
+
+func TestNewStencil(t *testing.T) {
+	cases := []struct {
+		name   string
+		rows   []string
+		ok     bool
+		radius int32
+		tiles  int
+	}{
+		{name: "cross", rows: crossRows, ok: true, radius: 1, tiles: 5},
+		{name: "single", rows: []string{"#"}, ok: true, radius: 0, tiles: 1},
+		{name: "full 5x5", rows: []string{"#####", "#####", "#####", "#####", "#####"}, ok: true, radius: 2, tiles: 25},
+		{name: "empty", rows: nil},
+		{name: "empty rows", rows: []string{"", "", ""}},
+		{name: "even", rows: []string{"##", "##"}},
+		{name: "ragged short", rows: []string{"###", "##", "###"}},
+		{name: "ragged long", rows: []string{"###", "####", "###"}},
+		{name: "not square", rows: []string{"#####", "#####", "#####"}},
+		{name: "bad char", rows: []string{"#x#", "###", "###"}},
+		{name: "center not claimed", rows: []string{"###", "#.#", "###"}},
+	}
+
+	for _, c := range cases {
+		st, err := NewStencil(c.rows)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok = %v", c.name, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if st.Radius() != c.radius || st.mask.Count() != c.tiles {
+			t.Errorf("%s: radius %d with %d tiles, want %d with %d", c.name, st.Radius(), st.mask.Count(), c.radius, c.tiles)
+		}
+	}
+}
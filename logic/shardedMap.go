@@ -0,0 +1,312 @@
+package logic
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 分区锁的区块边长为2^chunkBits
+const chunkBits = 6
+
+type chunkKey struct {
+	X int32
+	Y int32
+}
+
+func chunkOf(x int32, y int32) chunkKey {
+	return chunkKey{x >> chunkBits, y >> chunkBits}
+}
+
+// ShardedMap 按区块加锁的地图，相距较远的变更可以并行执行。
+// 一次变更锁住它可能读写的所有区块，以及涉及到的旗子所属的联盟：地块由区块锁保护，旗子的字段由联盟锁保护。
+// 加锁顺序固定为全局锁、联盟（按ID）、区块（按坐标），不会死锁。
+// 失效旗子的领地会变化的策略和依赖有效性的裁决策略下，一次变更的影响范围无法事先确定，此时所有变更依次执行。
+// 不记录撤销日志；监听者可能在多个goroutine中同时被调用
+type ShardedMap struct {
+	m     *Map
+	world sync.RWMutex //区域变更和查询持有读锁，影响整个地图的变更持有写锁
+
+	locksMu   sync.Mutex
+	chunks    map[chunkKey]*sync.Mutex
+	alliances map[int32]*sync.Mutex
+}
+
+// region 一次变更需要持有的锁
+type region struct {
+	alliances map[int32]bool
+	chunks    map[chunkKey]bool
+}
+
+func newRegion() *region {
+	return &region{
+		alliances: make(map[int32]bool),
+		chunks:    make(map[chunkKey]bool),
+	}
+}
+
+func (r *region) addRect(rect Rect) {
+	for cx := rect.MinX >> chunkBits; cx <= rect.MaxX>>chunkBits; cx++ {
+		for cy := rect.MinY >> chunkBits; cy <= rect.MaxY>>chunkBits; cy++ {
+			r.chunks[chunkKey{cx, cy}] = true
+		}
+	}
+}
+
+func (r *region) addFlag(f *Flag) {
+	r.alliances[f.AllianceId] = true
+	r.addRect(f.Bounds())
+}
+
+func (r *region) covers(o *region) bool {
+	for a := range o.alliances {
+		if !r.alliances[a] {
+			return false
+		}
+	}
+	for c := range o.chunks {
+		if !r.chunks[c] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *region) merge(o *region) {
+	for a := range o.alliances {
+		r.alliances[a] = true
+	}
+	for c := range o.chunks {
+		r.chunks[c] = true
+	}
+}
+
+// NewShardedMap 包装m，之后只能通过ShardedMap访问m；m为nil时新建地图
+func NewShardedMap(m *Map) *ShardedMap {
+	if m == nil {
+		m = NewMap()
+	}
+	m.SetJournalLimit(0)
+	m.shared = &sync.RWMutex{}
+
+	return &ShardedMap{
+		m:         m,
+		chunks:    make(map[chunkKey]*sync.Mutex),
+		alliances: make(map[int32]*sync.Mutex),
+	}
+}
+
+// regional 当前策略下变更的影响范围是否局限于相关旗子的范围
+func (s *ShardedMap) regional() bool {
+	_, preset := s.m.resolver.(*presetResolver)
+	return preset && s.m.resolver != ResolveValidFirst && s.m.invalidPolicy == InvalidKeep
+}
+
+// footprint seed放置或移除时可能读写的旗子：需要重放的旗子，以及与它们的范围相交的旗子，
+// 后者的地块、顶点和相邻关系可能随之变化
+func (s *ShardedMap) footprint(seed *Flag) map[*Flag]*Flag {
+	result := make(map[*Flag]*Flag)
+	result[seed] = seed
+	for f := range s.m.affectedFlags(seed) {
+		result[f] = f
+		for near := range s.m.flagsNear(f.Bounds()) {
+			result[near] = near
+		}
+	}
+	return result
+}
+
+// regionOf 读写flags需要持有的锁：它们的影响范围覆盖的区块，以及它们所属的联盟
+func regionOf(flags map[*Flag]*Flag) *region {
+	r := newRegion()
+	for f := range flags {
+		r.addFlag(f)
+	}
+	return r
+}
+
+// lock 按固定顺序加锁，返回按相反顺序解锁的函数
+func (s *ShardedMap) lock(r *region) func() {
+	alliances := make([]int32, 0, len(r.alliances))
+	for a := range r.alliances {
+		alliances = append(alliances, a)
+	}
+	sort.Slice(alliances, func(i, j int) bool { return alliances[i] < alliances[j] })
+
+	chunks := make([]chunkKey, 0, len(r.chunks))
+	for c := range r.chunks {
+		chunks = append(chunks, c)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].X < chunks[j].X || chunks[i].X == chunks[j].X && chunks[i].Y < chunks[j].Y
+	})
+
+	locks := make([]*sync.Mutex, 0, len(alliances)+len(chunks))
+	s.locksMu.Lock()
+	for _, a := range alliances {
+		l := s.alliances[a]
+		if l == nil {
+			l = &sync.Mutex{}
+			s.alliances[a] = l
+		}
+		locks = append(locks, l)
+	}
+	for _, c := range chunks {
+		l := s.chunks[c]
+		if l == nil {
+			l = &sync.Mutex{}
+			s.chunks[c] = l
+		}
+		locks = append(locks, l)
+	}
+	s.locksMu.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// withRegion 锁住seed的影响区域后执行fn；加锁前计算的区域可能已经变化，加锁后重新计算，不足时扩大后重试
+func (s *ShardedMap) withRegion(seed *Flag, fn func()) {
+	s.world.RLock()
+	if !s.regional() {
+		s.world.RUnlock()
+		s.world.Lock()
+		defer s.world.Unlock()
+		fn()
+		return
+	}
+	defer s.world.RUnlock()
+
+	r := regionOf(s.footprint(seed))
+	for {
+		unlock := s.lock(r)
+		next := regionOf(s.footprint(seed))
+		if r.covers(next) {
+			defer unlock()
+			fn()
+			return
+		}
+
+		unlock()
+		r.merge(next)
+	}
+}
+
+func (s *ShardedMap) AddFlag(x int32, y int32, allianceId int32, typeId int32, tm time.Time) (f *Flag, cs *ChangeSet, err error) {
+	flagType := GetFlagType(typeId)
+	if flagType == nil {
+		s.world.RLock()
+		defer s.world.RUnlock()
+		return nil, nil, s.m.CanPlaceFlag(x, y, allianceId, typeId)
+	}
+
+	// 还没有分配ID，按最小的ID计算，得到的影响范围只会更大
+	seed := NewFlag(x, y, allianceId, flagType, s.m, tm)
+	s.withRegion(seed, func() {
+		f, cs, err = s.m.AddFlag(x, y, allianceId, typeId, tm)
+	})
+	return
+}
+
+// RemoveFlag 旗子已被其他goroutine移除时返回ErrNotOnMap
+func (s *ShardedMap) RemoveFlag(flag *Flag) (cs *ChangeSet, err error) {
+	s.withRegion(flag, func() {
+		if !s.m.hasFlag(flag) {
+			err = ErrNotOnMap
+			return
+		}
+		cs = s.m.RemoveFlag(flag)
+	})
+	return
+}
+
+// GetTile 地块的归属由区块锁保护，有效性由所属联盟的锁保护，先读出归属再一并加锁
+func (s *ShardedMap) GetTile(x int32, y int32) (TileInfo, bool) {
+	s.world.RLock()
+	defer s.world.RUnlock()
+
+	r := newRegion()
+	r.chunks[chunkOf(x, y)] = true
+	for {
+		unlock := s.lock(r)
+		info, ok := tileInfo(s.m, x, y)
+		if !ok || r.alliances[info.AllianceId] {
+			unlock()
+			return info, ok
+		}
+
+		unlock()
+		r.alliances[info.AllianceId] = true
+	}
+}
+
+// NewBoundarySeeker 顶点和有效性只会被持有联盟锁的变更修改
+func (s *ShardedMap) NewBoundarySeeker(allianceId int32) *BoundarySeeker {
+	s.world.RLock()
+	defer s.world.RUnlock()
+
+	r := newRegion()
+	r.alliances[allianceId] = true
+	defer s.lock(r)()
+	return NewBoundarySeeker(s.m, allianceId)
+}
+
+// Update 独占整个地图执行fn，用于查询整个地图或执行没有分区版本的变更
+func (s *ShardedMap) Update(fn func(m *Map) error) error {
+	s.world.Lock()
+	defer s.world.Unlock()
+	return fn(s.m)
+}
+
+func (s *ShardedMap) SetTerrain(x int32, y int32, terrain Terrain) error {
+	return s.Update(func(m *Map) error {
+		return m.SetTerrain(x, y, terrain)
+	})
+}
+
+func (s *ShardedMap) Tick(now time.Time) (cs *ChangeSet) {
+	s.Update(func(m *Map) error {
+		cs = m.Tick(now)
+		return nil
+	})
+	return
+}
+
+func (s *ShardedMap) Batch(fn func(tx *Tx) error) (cs *ChangeSet, err error) {
+	s.Update(func(m *Map) error {
+		cs, err = m.Batch(fn)
+		return nil
+	})
+	return
+}
+
+func (m *Map) lockShared() {
+	if m.shared != nil {
+		m.shared.Lock()
+	}
+}
+
+func (m *Map) unlockShared() {
+	if m.shared != nil {
+		m.shared.Unlock()
+	}
+}
+
+func (m *Map) rlockShared() {
+	if m.shared != nil {
+		m.shared.RLock()
+	}
+}
+
+func (m *Map) runlockShared() {
+	if m.shared != nil {
+		m.shared.RUnlock()
+	}
+}
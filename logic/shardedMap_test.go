@@ -0,0 +1,203 @@
+package logic
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shardedWorker 在以origin为左上角的40x40范围内随机放置和移除旗子
+func shardedWorker(s *ShardedMap, seed int64, origin int32, steps int) {
+	rnd := rand.New(rand.NewSource(seed))
+	var flags []*Flag
+	for i := 0; i < steps; i++ {
+		if rnd.Intn(3) > 0 || len(flags) == 0 {
+			typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+			tm := time.Unix(int64(rnd.Intn(50)), 0)
+			f, _, err := s.AddFlag(origin+rnd.Int31n(40), origin+rnd.Int31n(40), rnd.Int31n(3)+1, typeId, tm)
+			if err == nil {
+				flags = append(flags, f)
+			}
+			continue
+		}
+
+		j := rnd.Intn(len(flags))
+		s.RemoveFlag(flags[j])
+		flags = append(flags[:j:j], flags[j+1:]...)
+	}
+}
+
+// 用go test -race运行才能发现数据竞争
+func TestShardedMapMatchesRebuild(t *testing.T) {
+	// 自定义策略下所有变更依次执行
+	custom := ChainResolvers(ResolveStrongest, ResolveEarliest)
+	for _, resolver := range []ConflictResolver{ResolveEarliest, ResolveNearest, custom} {
+		m := NewMap()
+		m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+		m.SetConflictResolver(resolver)
+		s := NewShardedMap(m)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 6; w++ {
+			// 前四个的区域互相重叠并跨越区块边界，其余各自在相距较远的区域
+			origin := int32(w) * 30
+			if w >= 4 {
+				origin = int32(w) * 300
+			}
+
+			wg.Add(1)
+			go func(seed int64, origin int32) {
+				defer wg.Done()
+				shardedWorker(s, seed, origin, 80)
+			}(int64(w), origin)
+		}
+
+		// 其他联盟的旗子放置后又移除，地图上的联盟随之增减
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int32(0); i < 40; i++ {
+				if f, _, err := s.AddFlag(3000+i*20, 3000, 10+i, FlagTypeFortress, time.Unix(0, 0)); err == nil {
+					s.RemoveFlag(f)
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 40; i++ {
+				s.NewBoundarySeeker(9)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(99))
+			for i := 0; i < 300; i++ {
+				s.GetTile(rnd.Int31n(1000)-10, rnd.Int31n(1000)-10)
+				if i%50 == 0 {
+					s.NewBoundarySeeker(rnd.Int31n(3) + 1)
+				}
+			}
+		}()
+
+		wg.Wait()
+
+		s.Update(func(m *Map) error {
+			assertSameAsReference(t, m, referenceMap(m, nil), fmt.Sprintf("%v after concurrent changes", resolver))
+			return nil
+		})
+	}
+}
+
+// flagStates 每面旗子除有效性外的状态
+func flagStates(m *Map) map[*Flag]string {
+	states := make(map[*Flag]string)
+	for _, f := range m.sortedFlags() {
+		states[f] = fmt.Sprint(f.Bitmap.Count(), sortFlags(f.Neighbors), sortFlags(f.Overlaps), f.Vertexes)
+	}
+	return states
+}
+
+// 变更读写的地块和旗子都应在事先计算的区域内
+func TestShardedMapFootprintCoversChange(t *testing.T) {
+	for seed := int64(0); seed < 6; seed++ {
+		resolver := []ConflictResolver{ResolveEarliest, ResolveNearest, ResolveStrongest}[seed%3]
+		rnd := rand.New(rand.NewSource(seed))
+		m, flags := randomMap(rnd, resolver, 60)
+		s := NewShardedMap(m)
+
+		check := func(footprint map[*Flag]*Flag, apply func() *ChangeSet) {
+			before := flagStates(m)
+			cs := apply()
+			if cs == nil {
+				return
+			}
+
+			covered := func(x int32, y int32) bool {
+				for f := range footprint {
+					if f.Bounds().Contains(x, y) {
+						return true
+					}
+				}
+				return false
+			}
+			for _, change := range cs.Tiles {
+				if !covered(change.X, change.Y) {
+					t.Fatalf("seed %d: tile %d:%d changed outside the footprint", seed, change.X, change.Y)
+				}
+			}
+			for f, state := range flagStates(m) {
+				if before[f] != "" && before[f] != state && footprint[f] == nil {
+					t.Fatalf("seed %d: flag %d changed outside the footprint", seed, f.ID)
+				}
+			}
+			alliances := regionOf(footprint).alliances
+			for _, f := range cs.Validity {
+				if !alliances[f.AllianceId] {
+					t.Fatalf("seed %d: validity of flag %d changed without its alliance lock", seed, f.ID)
+				}
+			}
+		}
+
+		for _, f := range flags {
+			check(s.footprint(f), func() *ChangeSet {
+				cs, _ := s.RemoveFlag(f)
+				return cs
+			})
+
+			x, y := rnd.Int31n(40), rnd.Int31n(40)
+			typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+			tm := time.Unix(int64(rnd.Intn(50)), 0)
+			check(s.footprint(NewFlag(x, y, 1, GetFlagType(typeId), m, tm)), func() *ChangeSet {
+				_, cs, _ := s.AddFlag(x, y, 1, typeId, tm)
+				return cs
+			})
+		}
+	}
+}
+
+// benchmarkParallelAdd 每个goroutine在自己的区域内放置要塞，超过8面时移除最早的一面
+func benchmarkParallelAdd(b *testing.B, add func(x int32, y int32, allianceId int32) *Flag, remove func(f *Flag)) {
+	var next int32
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt32(&next, 1)
+		origin := id * 1000
+		rnd := rand.New(rand.NewSource(int64(id)))
+
+		var flags []*Flag
+		for pb.Next() {
+			if f := add(origin+rnd.Int31n(200), origin+rnd.Int31n(200), id); f != nil {
+				flags = append(flags, f)
+			}
+			if len(flags) > 8 {
+				remove(flags[0])
+				flags = flags[1:]
+			}
+		}
+	})
+}
+
+func BenchmarkShardedMapParallel(b *testing.B) {
+	s := NewShardedMap(nil)
+	benchmarkParallelAdd(b, func(x int32, y int32, allianceId int32) *Flag {
+		f, _, _ := s.AddFlag(x, y, allianceId, FlagTypeFortress, time.Now())
+		return f
+	}, func(f *Flag) {
+		s.RemoveFlag(f)
+	})
+}
+
+func BenchmarkSafeMapParallel(b *testing.B) {
+	s := NewSafeMap(nil)
+	benchmarkParallelAdd(b, func(x int32, y int32, allianceId int32) *Flag {
+		f, _, _ := s.AddFlag(x, y, allianceId, FlagTypeFortress, time.Now())
+		return f
+	}, func(f *Flag) {
+		s.RemoveFlag(f)
+	})
+}
@@ -0,0 +1,534 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion 当前的快照格式版本，读取时兼容所有不高于它的版本。
+// 版本2：二进制格式中地块按所属旗子分组，坐标相对旗子所在地块；JSON格式与版本1相同
+const SnapshotVersion = 2
+
+var snapshotMagic = []byte("TRTY")
+
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+// Snapshot 地图的可序列化形式；旗子、地形和策略足以重建地图，Tiles和Overlaps是可选的推导状态
+type Snapshot struct {
+	Version    int             `json:"version"`
+	LastFlagId int32           `json:"lastFlagId"`
+	LastMTime  time.Time       `json:"lastMTime"`
+	Resolver   string          `json:"resolver,omitempty"` //内置策略名，自定义策略为空，读取后需要重新设置
+	Policy     InvalidPolicy   `json:"policy"`
+	Grace      time.Duration   `json:"grace"`
+	Flags      []FlagSnapshot  `json:"flags"`
+	Terrain    []TerrainRecord `json:"terrain,omitempty"`
+	Overlaps   [][2]int32      `json:"overlaps,omitempty"`
+	Tiles      []TileRecord    `json:"tiles,omitempty"`
+}
+
+type FlagSnapshot struct {
+	FlagSpec
+	IsValid   bool      `json:"valid"`
+	InvalidAt time.Time `json:"invalidAt"`
+}
+
+type TerrainRecord struct {
+	X       int32   `json:"x"`
+	Y       int32   `json:"y"`
+	Terrain Terrain `json:"terrain"`
+}
+
+type TileRecord struct {
+	X      int32 `json:"x"`
+	Y      int32 `json:"y"`
+	FlagId int32 `json:"flag"`
+}
+
+// Snapshot 导出地图，withTiles为true时一并导出地块归属和重叠关系，读取时可以不重建
+func (m *Map) Snapshot(withTiles bool) *Snapshot {
+	s := &Snapshot{
+		Version:    SnapshotVersion,
+		LastFlagId: m.lastFlagId,
+		LastMTime:  m.lastMTime,
+		Policy:     m.invalidPolicy,
+		Grace:      m.gracePeriod,
+	}
+
+	if preset, ok := m.resolver.(*presetResolver); ok {
+		s.Resolver = preset.name
+	}
+
+	flags := m.sortedFlags()
+	for _, f := range flags {
+		s.Flags = append(s.Flags, FlagSnapshot{f.Spec(), f.IsValid, f.InvalidAt})
+	}
+
+	for x, row := range m.terrain {
+		for y, terrain := range row {
+			s.Terrain = append(s.Terrain, TerrainRecord{x, y, terrain})
+		}
+	}
+	sort.Slice(s.Terrain, func(i, j int) bool {
+		a, b := s.Terrain[i], s.Terrain[j]
+		return a.X < b.X || a.X == b.X && a.Y < b.Y
+	})
+
+	if !withTiles {
+		return s
+	}
+
+	for _, f := range flags {
+		for _, o := range sortFlags(f.Overlaps) {
+			if f.ID < o.ID {
+				s.Overlaps = append(s.Overlaps, [2]int32{f.ID, o.ID})
+			}
+		}
+
+		f.Bitmap.Each(func(dx int32, dy int32) {
+			s.Tiles = append(s.Tiles, TileRecord{f.Tile.X + dx, f.Tile.Y + dy, f.ID})
+		})
+	}
+	if s.Tiles == nil {
+		s.Tiles = []TileRecord{}
+	}
+
+	return s
+}
+
+// NewMapFromSnapshot 读取快照；trustTiles为true且快照带有地块归属时直接采用，否则按旗子重建
+func NewMapFromSnapshot(s *Snapshot, trustTiles bool) (*Map, error) {
+	m := NewMap()
+	if err := m.load(s, trustTiles); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Map) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot(true))
+}
+
+// UnmarshalJSON 用快照替换地图的全部内容，保留监听者
+func (m *Map) UnmarshalJSON(data []byte) error {
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
+	}
+	return m.replace(s, true)
+}
+
+func (m *Map) MarshalBinary() ([]byte, error) {
+	return m.Snapshot(true).MarshalBinary()
+}
+
+// UnmarshalBinary 用快照替换地图的全部内容，保留监听者
+func (m *Map) UnmarshalBinary(data []byte) error {
+	s := &Snapshot{}
+	if err := s.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return m.replace(s, true)
+}
+
+// replace 把快照读入新地图，成功后才替换m的内容，失败时m保持原样；监听者、时钟和日志设置不变
+func (m *Map) replace(s *Snapshot, trustTiles bool) error {
+	loaded := NewMap()
+	if m.clock != nil {
+		loaded.clock = m.clock
+		loaded.journalLimit = m.journalLimit
+		loaded.vertexWorkers = m.vertexWorkers
+	}
+	if err := loaded.load(s, trustTiles); err != nil {
+		return err
+	}
+
+	for _, flags := range loaded.flags {
+		for f := range flags {
+			f.Map = m
+		}
+	}
+
+	m.tiles, m.flags, m.fortresses, m.terrain, m.index = loaded.tiles, loaded.flags, loaded.fortresses, loaded.terrain, loaded.index
+	m.resolver, m.invalidPolicy, m.gracePeriod = loaded.resolver, loaded.invalidPolicy, loaded.gracePeriod
+	m.lastFlagId, m.lastMTime = loaded.lastFlagId, loaded.lastMTime
+	m.clock, m.journalLimit, m.vertexWorkers = loaded.clock, loaded.journalLimit, loaded.vertexWorkers
+	m.clearJournal()
+	return nil
+}
+
+// load 把快照读入新建的地图
+func (m *Map) load(s *Snapshot, trustTiles bool) error {
+	if s.Version < 1 || s.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	for _, t := range s.Terrain {
+		if TerrainTypes[t.Terrain] == nil {
+			return fmt.Errorf("%w: unknown terrain %d at %d:%d", ErrBadSnapshot, t.Terrain, t.X, t.Y)
+		}
+	}
+
+	if s.Policy < InvalidKeep || s.Policy > InvalidRelease {
+		return fmt.Errorf("%w: unknown invalid policy %d", ErrBadSnapshot, s.Policy)
+	}
+
+	if r := presetByName(s.Resolver); r != nil {
+		m.resolver = r
+	}
+	m.invalidPolicy = s.Policy
+	m.gracePeriod = s.Grace
+
+	for _, t := range s.Terrain {
+		m.setTerrain(t.X, t.Y, t.Terrain)
+	}
+
+	specs := make([]FlagSpec, 0, len(s.Flags))
+	for _, f := range s.Flags {
+		specs = append(specs, f.FlagSpec)
+	}
+	if err := m.addSpecs(specs); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	if s.LastFlagId > m.lastFlagId {
+		m.lastFlagId = s.LastFlagId
+	}
+	if s.LastMTime.After(m.lastMTime) {
+		m.lastMTime = s.LastMTime
+	}
+
+	byId := make(map[int32]*Flag, len(s.Flags))
+	for _, f := range m.sortedFlags() {
+		byId[f.ID] = f
+	}
+	for _, fs := range s.Flags {
+		if f := byId[fs.ID]; f != nil {
+			f.InvalidAt = fs.InvalidAt
+			f.IsValid = fs.IsValid
+		}
+	}
+
+	if trustTiles && s.Tiles != nil {
+		if err := m.restoreTiles(s, byId); err != nil {
+			return err
+		}
+	} else {
+		m.Rebuild()
+	}
+
+	m.clearJournal()
+	return nil
+}
+
+// restoreTiles 直接采用快照中的地块归属和重叠关系，相邻关系、有效性和顶点由此推导
+func (m *Map) restoreTiles(s *Snapshot, byId map[int32]*Flag) error {
+	flags := m.sortedFlags()
+	m.flags = make(map[int32]map[*Flag]*Flag)
+
+	op := m.newOperation()
+	op.silent = true
+	op.journal = false
+	op.unchecked = true
+	for _, f := range flags {
+		m.registerFlag(op, f)
+		op.touchVertex(f)
+		op.touchAlliance(f.AllianceId)
+	}
+
+	for _, t := range s.Tiles {
+		f := byId[t.FlagId]
+		if f == nil || !f.Bitmap.Contains(t.X-f.Tile.X, t.Y-f.Tile.Y) || !f.InArea(t.X, t.Y) || m.isBlocked(t.X, t.Y) {
+			return fmt.Errorf("%w: tile %d:%d owned by flag %d", ErrBadSnapshot, t.X, t.Y, t.FlagId)
+		}
+
+		op.setOwner(t.X, t.Y, f)
+	}
+
+	for _, pair := range s.Overlaps {
+		a, b := byId[pair[0]], byId[pair[1]]
+		if a == nil || b == nil {
+			return fmt.Errorf("%w: overlap %d-%d", ErrBadSnapshot, pair[0], pair[1])
+		}
+		a.AddOverlap(b)
+	}
+
+	op.finish()
+
+	// 每条记录单独看都合法，整体上仍可能缺少旗子所在地块等
+	if violations := m.Validate(); len(violations) > 0 {
+		return fmt.Errorf("%w: %v", ErrBadSnapshot, violations[0])
+	}
+	return nil
+}
+
+// MarshalBinary 紧凑的二进制格式：魔数、版本号，之后的字段都用变长整数编码
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	w := &snapshotWriter{}
+	w.buf.Write(snapshotMagic)
+	w.uvarint(uint64(s.Version))
+	w.varint(int64(s.LastFlagId))
+	w.time(s.LastMTime)
+	w.uvarint(uint64(len(s.Resolver)))
+	w.buf.WriteString(s.Resolver)
+	w.varint(int64(s.Policy))
+	w.varint(int64(s.Grace))
+
+	w.uvarint(uint64(len(s.Flags)))
+	for _, f := range s.Flags {
+		w.varint(int64(f.ID))
+		w.varint(int64(f.AllianceId))
+		w.varint(int64(f.X))
+		w.varint(int64(f.Y))
+		w.varint(int64(f.TypeId))
+		w.time(f.MTime)
+		w.time(f.InvalidAt)
+
+		var bits byte
+		if f.Released {
+			bits |= 1
+		}
+		if f.IsValid {
+			bits |= 2
+		}
+		w.buf.WriteByte(bits)
+	}
+
+	w.uvarint(uint64(len(s.Terrain)))
+	for _, t := range s.Terrain {
+		w.varint(int64(t.X))
+		w.varint(int64(t.Y))
+		w.buf.WriteByte(byte(t.Terrain))
+	}
+
+	if s.Tiles == nil {
+		w.buf.WriteByte(0)
+		return w.buf.Bytes(), nil
+	}
+
+	w.buf.WriteByte(1)
+	w.uvarint(uint64(len(s.Overlaps)))
+	for _, pair := range s.Overlaps {
+		w.varint(int64(pair[0]))
+		w.varint(int64(pair[1]))
+	}
+
+	if err := s.writeTiles(w); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// writeTiles 按旗子分组写入地块：旗子数，之后每面旗子的ID、地块数和相对旗子的坐标
+func (s *Snapshot) writeTiles(w *snapshotWriter) error {
+	centers := make(map[int32]Vector2, len(s.Flags))
+	for _, f := range s.Flags {
+		centers[f.ID] = Vector2{f.X, f.Y}
+	}
+
+	var order []int32
+	groups := make(map[int32][]TileRecord)
+	for _, t := range s.Tiles {
+		if _, ok := centers[t.FlagId]; !ok {
+			return fmt.Errorf("%w: tile %d:%d owned by unknown flag %d", ErrBadSnapshot, t.X, t.Y, t.FlagId)
+		}
+		if groups[t.FlagId] == nil {
+			order = append(order, t.FlagId)
+		}
+		groups[t.FlagId] = append(groups[t.FlagId], t)
+	}
+
+	w.uvarint(uint64(len(order)))
+	for _, id := range order {
+		center := centers[id]
+		w.varint(int64(id))
+		w.uvarint(uint64(len(groups[id])))
+		for _, t := range groups[id] {
+			w.varint(int64(t.X - center.X))
+			w.varint(int64(t.Y - center.Y))
+		}
+	}
+	return nil
+}
+
+// readTiles 按写入时的版本读取地块
+func (s *Snapshot) readTiles(r *snapshotReader) {
+	s.Tiles = []TileRecord{}
+
+	// 版本1逐个写入地块的绝对坐标和所属旗子
+	if s.Version == 1 {
+		for n := r.count(); n > 0; n-- {
+			s.Tiles = append(s.Tiles, TileRecord{r.int32(), r.int32(), r.int32()})
+		}
+		return
+	}
+
+	centers := make(map[int32]Vector2, len(s.Flags))
+	for _, f := range s.Flags {
+		centers[f.ID] = Vector2{f.X, f.Y}
+	}
+	for groups := r.count(); groups > 0; groups-- {
+		id := r.int32()
+		center, ok := centers[id]
+		if !ok && r.err == nil {
+			r.fail(fmt.Errorf("tiles of unknown flag %d", id))
+		}
+		for n := r.count(); n > 0; n-- {
+			s.Tiles = append(s.Tiles, TileRecord{center.X + r.int32(), center.Y + r.int32(), id})
+		}
+	}
+}
+
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return ErrBadSnapshot
+	}
+
+	r := &snapshotReader{r: bytes.NewReader(data[len(snapshotMagic):])}
+	*s = Snapshot{}
+	s.Version = int(r.uvarint())
+	if r.err == nil && (s.Version < 1 || s.Version > SnapshotVersion) {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	s.LastFlagId = r.int32()
+	s.LastMTime = r.time()
+	s.Resolver = string(r.bytes(r.count()))
+	s.Policy = InvalidPolicy(r.varint())
+	s.Grace = time.Duration(r.varint())
+
+	for n := r.count(); n > 0; n-- {
+		f := FlagSnapshot{}
+		f.ID = r.int32()
+		f.AllianceId = r.int32()
+		f.X = r.int32()
+		f.Y = r.int32()
+		f.TypeId = r.int32()
+		f.MTime = r.time()
+		f.InvalidAt = r.time()
+		bits := r.byte()
+		f.Released = bits&1 != 0
+		f.IsValid = bits&2 != 0
+		s.Flags = append(s.Flags, f)
+	}
+
+	for n := r.count(); n > 0; n-- {
+		s.Terrain = append(s.Terrain, TerrainRecord{r.int32(), r.int32(), Terrain(r.byte())})
+	}
+
+	if r.byte() == 1 {
+		for n := r.count(); n > 0; n-- {
+			s.Overlaps = append(s.Overlaps, [2]int32{r.int32(), r.int32()})
+		}
+
+		s.readTiles(r)
+	}
+
+	return r.err
+}
+
+type snapshotWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *snapshotWriter) varint(v int64) {
+	w.buf.Write(w.tmp[:binary.PutVarint(w.tmp[:], v)])
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.buf.Write(w.tmp[:binary.PutUvarint(w.tmp[:], v)])
+}
+
+func (w *snapshotWriter) time(t time.Time) {
+	w.varint(t.Unix())
+	w.uvarint(uint64(t.Nanosecond()))
+}
+
+// snapshotReader 读到错误后不再读取，所有方法返回零值，最后统一检查err
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *snapshotReader) fail(err error) {
+	if r.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *snapshotReader) int32() int32 {
+	return int32(r.varint())
+}
+
+// count 读取元素个数，不能超过剩余字节数，防止损坏的数据导致巨量分配
+func (r *snapshotReader) count() int {
+	n := r.uvarint()
+	if n > uint64(r.r.Len()) {
+		r.fail(errors.New("count exceeds data"))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *snapshotReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.fail(err)
+	}
+	return b
+}
+
+func (r *snapshotReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.fail(err)
+	}
+	return b
+}
+
+func (r *snapshotReader) time() time.Time {
+	sec := r.varint()
+	nsec := r.uvarint()
+	if r.err != nil || nsec >= 1e9 {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
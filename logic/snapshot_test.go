@@ -0,0 +1,253 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata snapshots of the current version")
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	resolvers := []ConflictResolver{ResolveEarliest, ResolveNearest, ResolveStrongest}
+	for seed := int64(0); seed < 20; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		m, _ := randomMap(rnd, resolvers[seed%3], 30)
+		if seed%2 == 1 {
+			m.SetInvalidPolicy(InvalidYield, 0)
+		}
+		want := dumpState(m)
+
+		bin, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := &Map{}
+		if err := loaded.UnmarshalBinary(bin); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if got := dumpState(loaded); got != want {
+			t.Fatalf("seed %d: binary snapshot:\n%s\nwant:\n%s", seed, got, want)
+		}
+
+		loaded = NewMap()
+		if err := json.Unmarshal(js, loaded); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if got := dumpState(loaded); got != want {
+			t.Fatalf("seed %d: json snapshot:\n%s\nwant:\n%s", seed, got, want)
+		}
+
+		rebuilt, err := NewMapFromSnapshot(m.Snapshot(false), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dumpState(rebuilt); got != want {
+			t.Fatalf("seed %d: rebuilt snapshot:\n%s\nwant:\n%s", seed, got, want)
+		}
+		if violations := loaded.Validate(); len(violations) > 0 {
+			t.Fatalf("seed %d: %v", seed, violations[0])
+		}
+	}
+}
+
+func TestSnapshotKeepsNextFlagId(t *testing.T) {
+	m := NewMap()
+	f, _, err := m.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RemoveFlag(f)
+
+	loaded, err := NewMapFromSnapshot(m.Snapshot(true), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _, err := loaded.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID == f.ID {
+		t.Fatalf("flag id %d reused after load", g.ID)
+	}
+}
+
+func TestSnapshotRejectsBadData(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	m, _ := randomMap(rnd, ResolveEarliest, 20)
+	bin, _ := m.MarshalBinary()
+
+	for i := 0; i < len(bin); i++ {
+		if err := (&Snapshot{}).UnmarshalBinary(bin[:i]); err == nil {
+			t.Fatalf("truncated at %d: no error", i)
+		}
+	}
+
+	s := m.Snapshot(true)
+	s.Version = SnapshotVersion + 1
+	if _, err := NewMapFromSnapshot(s, true); err == nil {
+		t.Fatal("newer version loaded")
+	}
+
+	s = m.Snapshot(true)
+	s.Tiles = append(s.Tiles, TileRecord{1000, 1000, s.Flags[0].ID})
+	if _, err := NewMapFromSnapshot(s, true); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("tile outside the flag's area: %v", err)
+	}
+
+	// 在旗子位图范围内，但不在菱形范围内
+	outpost := NewMap()
+	f, _, _ := outpost.AddFlag(0, 0, 1, FlagTypeCapital, time.Unix(0, 0))
+	g, _, err := outpost.AddFlag(12, 0, 1, FlagTypeOutpost, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = outpost.Snapshot(true)
+	s.Tiles = append(s.Tiles, TileRecord{g.Tile.X + 3, g.Tile.Y + 3, g.ID})
+	if _, err := NewMapFromSnapshot(s, true); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("tile outside the flag's shape: %v", err)
+	}
+
+	s = outpost.Snapshot(true)
+	s.Terrain = append(s.Terrain, TerrainRecord{f.Tile.X + 1, f.Tile.Y, TerrainWater})
+	if _, err := NewMapFromSnapshot(s, true); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("tile on blocked terrain: %v", err)
+	}
+
+	// 每条记录都合法，但缺少旗子所在的地块
+	s = outpost.Snapshot(true)
+	for i, t := range s.Tiles {
+		if t.X == g.Tile.X && t.Y == g.Tile.Y {
+			s.Tiles = append(s.Tiles[:i:i], s.Tiles[i+1:]...)
+			break
+		}
+	}
+	if _, err := NewMapFromSnapshot(s, true); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("flag tile missing: %v", err)
+	}
+
+	s = m.Snapshot(true)
+	s.Policy = InvalidRelease + 1
+	if _, err := NewMapFromSnapshot(s, true); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("unknown invalid policy: %v", err)
+	}
+
+	s = m.Snapshot(false)
+	s.Flags = append(s.Flags, s.Flags[0])
+	if _, err := NewMapFromSnapshot(s, false); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("duplicate flag: %v", err)
+	}
+}
+
+// goldenMap 生成快照测试数据所用的地图，修改它需要重新生成testdata下所有版本的快照
+func goldenMap() *Map {
+	m := NewMap()
+	m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	m.SetConflictResolver(ResolveNearest)
+	m.SetInvalidPolicy(InvalidYield, time.Minute)
+	m.SetTerrain(9, 5, TerrainWater)
+	m.SetTerrain(9, 6, TerrainWater)
+	m.SetTerrain(12, 9, TerrainForest)
+
+	for i, spec := range []FlagSpec{
+		{AllianceId: 1, X: 5, Y: 5, TypeId: FlagTypeFortress},
+		{AllianceId: 1, X: 14, Y: 5, TypeId: FlagTypeWatchtower},
+		{AllianceId: 2, X: 24, Y: 8, TypeId: FlagTypeFortress},
+		{AllianceId: 2, X: 19, Y: 14, TypeId: FlagTypeOutpost},
+		{AllianceId: 1, X: 14, Y: 13, TypeId: FlagTypeOutpost},
+		{AllianceId: 3, X: 40, Y: 40, TypeId: FlagTypeCapital},
+	} {
+		if _, _, err := m.AddFlag(spec.X, spec.Y, spec.AllianceId, spec.TypeId, time.Unix(int64(i), 0)); err != nil {
+			panic(err)
+		}
+	}
+
+	// 移除联盟1的要塞，它的其余旗子失效
+	m.RemoveFlag(m.flagById(1))
+	return m
+}
+
+// 读取失败时地图保持原样
+func TestSnapshotFailedLoadKeepsMap(t *testing.T) {
+	m := goldenMap()
+	want := dumpState(m)
+
+	bin, _ := m.MarshalBinary()
+	if err := m.UnmarshalBinary(bin[:len(bin)-1]); err == nil {
+		t.Fatal("truncated snapshot loaded")
+	}
+
+	s := m.Snapshot(true)
+	s.Tiles = append(s.Tiles, TileRecord{1000, 1000, s.Flags[0].ID})
+	js, _ := json.Marshal(s)
+	if err := m.UnmarshalJSON(js); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("bad tile: %v", err)
+	}
+
+	if got := dumpState(m); got != want {
+		t.Fatalf("map changed by failed loads:\n%s\nwant:\n%s", got, want)
+	}
+	if _, _, err := m.AddFlag(60, 60, 4, FlagTypeFortress, time.Unix(10, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testdata下保存了各版本写出的goldenMap，都应读出相同的地图；-update重写当前版本的文件
+func TestSnapshotGoldenFiles(t *testing.T) {
+	m := goldenMap()
+	want := dumpState(m)
+
+	if *updateGolden {
+		bin, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join("testdata", fmt.Sprintf("snapshot_v%d.bin", SnapshotVersion))
+		if err := os.WriteFile(name, bin, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "snapshot_v*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[string]bool)
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := &Map{}
+		if filepath.Ext(name) == ".json" {
+			err = loaded.UnmarshalJSON(data)
+		} else {
+			err = loaded.UnmarshalBinary(data)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := dumpState(loaded); got != want {
+			t.Fatalf("%s:\n%s\nwant:\n%s", name, got, want)
+		}
+		versions[filepath.Base(name)] = true
+	}
+
+	for v := 1; v <= SnapshotVersion; v++ {
+		if name := fmt.Sprintf("snapshot_v%d.bin", v); !versions[name] {
+			t.Errorf("missing testdata/%s", name)
+		}
+	}
+}
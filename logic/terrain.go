@@ -0,0 +1,111 @@
+package logic
+
+type Terrain uint8
+
+const (
+	TerrainPlain Terrain = iota
+	TerrainWater
+	TerrainMountain
+	TerrainImpassable
+	TerrainForest
+	TerrainHill
+)
+
+type TerrainType struct {
+	Terrain  Terrain
+	Name     string
+	Blocking bool  //不可占领，也不可穿越
+	Cost     int32 //按预算扩张时进入该地块的消耗
+}
+
+var TerrainTypes = make(map[Terrain]*TerrainType)
+
+func (t Terrain) Type() *TerrainType {
+	return TerrainTypes[t]
+}
+
+func (t Terrain) IsBlocking() bool {
+	tt := TerrainTypes[t]
+	return tt != nil && tt.Blocking
+}
+
+// Cost 进入该地形的消耗，至少为1
+func (t Terrain) Cost() int32 {
+	tt := TerrainTypes[t]
+	if tt == nil || tt.Cost < 1 {
+		return 1
+	}
+	return tt.Cost
+}
+
+func (m *Map) GetTerrain(x int32, y int32) Terrain {
+	return m.terrain[x][y]
+}
+
+// SetTerrain 设置地形，范围覆盖该地块的旗子会重放；旗子所在地块不能设为阻挡地形
+func (m *Map) SetTerrain(x int32, y int32, terrain Terrain) error {
+	if err := m.checkTerrain(x, y, terrain); err != nil {
+		return err
+	}
+
+	if m.GetTerrain(x, y) == terrain {
+		return nil
+	}
+
+	op := m.newOperation()
+	prev := m.GetTerrain(x, y)
+	m.setTerrain(x, y, terrain)
+	op.record(func(op *operation) {
+		m.setTerrain(x, y, prev)
+	})
+
+	var seeds []*Flag
+	for f := range m.flagsNear(Rect{x, y, x, y}) {
+		seeds = append(seeds, f)
+	}
+
+	if len(seeds) > 0 {
+		m.replay(op, m.affectedFlags(seeds...))
+	}
+	op.finish()
+
+	return nil
+}
+
+// checkTerrain 检查能否把地块设为terrain
+func (m *Map) checkTerrain(x int32, y int32, terrain Terrain) error {
+	if TerrainTypes[terrain] == nil {
+		return ErrUnknownTerrain
+	}
+
+	if terrain.IsBlocking() {
+		if tile, ex := m.GetTile(x, y, false); ex && tile.IsFlag() {
+			return ErrOccupied
+		}
+	}
+	return nil
+}
+
+func (m *Map) setTerrain(x int32, y int32, terrain Terrain) {
+	row := m.terrain[x]
+	if terrain == TerrainPlain {
+		if row != nil {
+			delete(row, y)
+			if len(row) == 0 {
+				delete(m.terrain, x)
+			}
+		}
+		return
+	}
+
+	if row == nil {
+		row = make(map[int32]Terrain)
+		m.terrain[x] = row
+	}
+
+	row[y] = terrain
+}
+
+func (m *Map) isBlocked(x int32, y int32) bool {
+	return m.GetTerrain(x, y).IsBlocking()
+}
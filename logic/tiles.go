@@ -0,0 +1,164 @@
+package logic
+
+// 地块按区块存储，区块与ShardedMap加锁的区块一致
+const chunkSize = 1 << chunkBits
+
+// tileChunk 区块内每个地块所属旗子的编号，0表示无主
+type tileChunk struct {
+	owners [chunkSize * chunkSize]uint32
+	count  int32 //有主的地块数，为0时释放区块
+}
+
+func chunkIndex(x int32, y int32) int32 {
+	return (y&(chunkSize-1))<<chunkBits | x&(chunkSize-1)
+}
+
+// tileStore 按区块懒分配的地块存储。地块只记录旗子的编号，旗子有领地时才占用编号，领地清空后编号回收
+type tileStore struct {
+	chunks map[chunkKey]*tileChunk
+	flags  []*Flag  //编号到旗子，0号不使用
+	free   []uint32 //可复用的编号
+}
+
+func newTileStore() *tileStore {
+	return &tileStore{
+		chunks: make(map[chunkKey]*tileChunk),
+		flags:  []*Flag{nil},
+	}
+}
+
+func (s *tileStore) owner(x int32, y int32) *Flag {
+	c := s.chunks[chunkOf(x, y)]
+	if c == nil {
+		return nil
+	}
+	return s.flags[c.owners[chunkIndex(x, y)]]
+}
+
+// surroundMask 周围8个地块中与(x, y)同盟的掩码，第i位对应Orientations[i]；无主的(x, y)按联盟0计算
+func (s *tileStore) surroundMask(x int32, y int32) uint8 {
+	owner := s.owner
+	lx, ly := x&(chunkSize-1), y&(chunkSize-1)
+	if lx > 0 && lx < chunkSize-1 && ly > 0 && ly < chunkSize-1 {
+		// 不在区块边缘时周围的地块都在同一个区块内，只查一次区块
+		c := s.chunks[chunkOf(x, y)]
+		if c == nil {
+			return 0
+		}
+		owner = func(x int32, y int32) *Flag {
+			return s.flags[c.owners[chunkIndex(x, y)]]
+		}
+	}
+
+	var allianceId int32
+	if center := owner(x, y); center != nil {
+		allianceId = center.AllianceId
+	}
+
+	var mask uint8
+	for i, o := range Orientations {
+		if f := owner(x+o.X, y+o.Y); f != nil && f.AllianceId == allianceId {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// set 修改地块归属，flag为nil时还原为无主，返回原来的归属
+func (s *tileStore) set(x int32, y int32, flag *Flag) *Flag {
+	key := chunkOf(x, y)
+	c := s.chunks[key]
+	if c == nil {
+		if flag == nil {
+			return nil
+		}
+		c = &tileChunk{}
+		s.chunks[key] = c
+	}
+
+	i := chunkIndex(x, y)
+	prev := s.flags[c.owners[i]]
+	if prev == flag {
+		return prev
+	}
+
+	if flag == nil {
+		c.owners[i] = 0
+		c.count--
+		if c.count == 0 {
+			delete(s.chunks, key)
+		}
+		return prev
+	}
+
+	if flag.slot == 0 {
+		if n := len(s.free); n > 0 {
+			flag.slot = s.free[n-1]
+			s.free = s.free[:n-1]
+		} else {
+			flag.slot = uint32(len(s.flags))
+			s.flags = append(s.flags, nil)
+		}
+		s.flags[flag.slot] = flag
+	}
+
+	if prev == nil {
+		c.count++
+	}
+	c.owners[i] = flag.slot
+	return prev
+}
+
+// release 旗子不再拥有地块时回收其编号
+func (s *tileStore) release(flag *Flag) {
+	if flag.slot == 0 {
+		return
+	}
+	s.flags[flag.slot] = nil
+	s.free = append(s.free, flag.slot)
+	flag.slot = 0
+}
+
+// each 遍历所有有主的地块，顺序不确定
+func (s *tileStore) each(fn func(x int32, y int32, owner *Flag)) {
+	for key, c := range s.chunks {
+		for i, slot := range c.owners {
+			if slot != 0 {
+				fn(key.X<<chunkBits|int32(i)&(chunkSize-1), key.Y<<chunkBits|int32(i)>>chunkBits, s.flags[slot])
+			}
+		}
+	}
+}
+
+// ownerAt 读取地块的归属，不创建Tile
+func (m *Map) ownerAt(x int32, y int32) *Flag {
+	if m.shared == nil {
+		return m.tiles.owner(x, y)
+	}
+
+	m.shared.RLock()
+	owner := m.tiles.owner(x, y)
+	m.shared.RUnlock()
+	return owner
+}
+
+// setOwnerAt 修改地块归属并维护旗子的位图，flag为nil时还原为无主
+func (m *Map) setOwnerAt(x int32, y int32, flag *Flag) {
+	m.lockShared()
+	defer m.unlockShared()
+
+	prev := m.tiles.set(x, y, flag)
+	if prev == flag {
+		return
+	}
+
+	if flag != nil {
+		flag.Bitmap.Set(x-flag.Tile.X, y-flag.Tile.Y)
+	}
+	if prev != nil {
+		prev.Bitmap.Clear(x-prev.Tile.X, y-prev.Tile.Y)
+		if prev.Bitmap.Count() == 0 {
+			m.tiles.release(prev)
+		}
+	}
+}
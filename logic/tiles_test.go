@@ -0,0 +1,118 @@
+package logic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTileStoreReleasesChunksAndSlots(t *testing.T) {
+	m := NewMap()
+	a := NewFlag(0, 0, 1, GetFlagType(FlagTypeFortress), m, time.Unix(0, 0))
+	b := NewFlag(100, 100, 1, GetFlagType(FlagTypeFortress), m, time.Unix(0, 0))
+
+	m.setOwnerAt(0, 0, a)
+	m.setOwnerAt(-1, 0, a)
+	m.setOwnerAt(100, 100, b)
+	if len(m.tiles.chunks) != 3 {
+		t.Fatalf("%d chunks, want 3", len(m.tiles.chunks))
+	}
+	if m.ownerAt(-1, 0) != a || m.ownerAt(100, 100) != b || m.ownerAt(1, 0) != nil {
+		t.Fatal("wrong owners")
+	}
+
+	m.setOwnerAt(-1, 0, nil)
+	m.setOwnerAt(0, 0, nil)
+	if len(m.tiles.chunks) != 1 || a.slot != 0 || a.Bitmap.Count() != 0 {
+		t.Fatalf("released flag still holds %d chunks, slot %d", len(m.tiles.chunks), a.slot)
+	}
+
+	// 编号回收后复用
+	c := NewFlag(101, 100, 2, GetFlagType(FlagTypeFortress), m, time.Unix(0, 0))
+	m.setOwnerAt(101, 100, c)
+	if m.ownerAt(100, 100) != b || m.ownerAt(101, 100) != c || len(m.tiles.flags) != 3 {
+		t.Fatalf("slot not reused: %d slots", len(m.tiles.flags))
+	}
+}
+
+// 大地图上的基准：旧的两级哈希表作为对照
+const benchWorldSide = 2000
+
+type nestedTiles map[int32]map[int32]*Tile
+
+func (n nestedTiles) set(x int32, y int32, flag *Flag) {
+	row := n[x]
+	if row == nil {
+		row = make(map[int32]*Tile)
+		n[x] = row
+	}
+	row[y] = &Tile{Vector2: Vector2{x, y}, ownerFlag: flag}
+}
+
+func (n nestedTiles) owner(x int32, y int32) *Flag {
+	if t := n[x][y]; t != nil {
+		return t.ownerFlag
+	}
+	return nil
+}
+
+// benchOwners 每15x15的方块属于同一面旗子，覆盖整个大地图
+func benchOwners(fn func(x int32, y int32, flag *Flag)) {
+	flags := make(map[Vector2]*Flag)
+	for x := int32(0); x < benchWorldSide; x++ {
+		for y := int32(0); y < benchWorldSide; y++ {
+			key := Vector2{x / 15, y / 15}
+			f := flags[key]
+			if f == nil {
+				f = &Flag{ID: int32(len(flags) + 1), Tile: &Tile{Vector2: Vector2{key.X*15 + 7, key.Y*15 + 7}}, Bitmap: NewBitmap(7)}
+				flags[key] = f
+			}
+			fn(x, y, f)
+		}
+	}
+}
+
+func BenchmarkTileStoreFill(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := newTileStore()
+		benchOwners(func(x int32, y int32, flag *Flag) {
+			s.set(x, y, flag)
+		})
+	}
+}
+
+func BenchmarkNestedTilesFill(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		n := make(nestedTiles)
+		benchOwners(n.set)
+	}
+}
+
+// benchLookups 在大地图上随机查询地块及其周围8个地块，与CalcVertexCode的访问方式相同
+func benchLookups(b *testing.B, owner func(x int32, y int32) *Flag) {
+	rnd := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x, y := rnd.Int31n(benchWorldSide), rnd.Int31n(benchWorldSide)
+		for _, o := range Orientations {
+			owner(x+o.X, y+o.Y)
+		}
+	}
+}
+
+func BenchmarkTileStoreLookup(b *testing.B) {
+	s := newTileStore()
+	benchOwners(func(x int32, y int32, flag *Flag) {
+		s.set(x, y, flag)
+	})
+	benchLookups(b, s.owner)
+}
+
+func BenchmarkNestedTilesLookup(b *testing.B) {
+	n := make(nestedTiles)
+	benchOwners(n.set)
+	benchLookups(b, n.owner)
+}
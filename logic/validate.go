@@ -0,0 +1,197 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+)
+
+type ViolationKind int
+
+const (
+	ViolationEmptyTile          ViolationKind = iota + 1 //地块记录的编号没有对应的旗子
+	ViolationUnknownOwner                                //地块归属不在地图上的旗子
+	ViolationMissingBit                                  //地块归属旗子，但旗子位图未置位
+	ViolationStrayBit                                    //位图置位，但地块不存在或不归属该旗子
+	ViolationOutOfArea                                   //地块不在所属旗子的占领范围内或为阻挡地形
+	ViolationFlagTile                                    //旗子所在地块不归属该旗子
+	ViolationAsymmetricNeighbor                          //Neighbors不对称
+	ViolationAsymmetricOverlap                           //Overlaps不对称
+	ViolationNeighbor                                    //Neighbors与地块的相邻关系不一致
+	ViolationVertex                                      //Vertexes与CalcVertexCode不一致
+	ViolationValidity                                    //IsValid与到要塞的连通性不一致
+)
+
+var violationNames = map[ViolationKind]string{
+	ViolationEmptyTile:          "empty tile",
+	ViolationUnknownOwner:       "unknown owner",
+	ViolationMissingBit:         "missing bitmap bit",
+	ViolationStrayBit:           "stray bitmap bit",
+	ViolationOutOfArea:          "tile out of area",
+	ViolationFlagTile:           "flag tile not owned by flag",
+	ViolationAsymmetricNeighbor: "asymmetric neighbor",
+	ViolationAsymmetricOverlap:  "asymmetric overlap",
+	ViolationNeighbor:           "neighbor mismatch",
+	ViolationVertex:             "vertex mismatch",
+	ViolationValidity:           "validity mismatch",
+}
+
+func (k ViolationKind) String() string {
+	if name, ok := violationNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("violation(%d)", int(k))
+}
+
+// Violation 一处不一致，Flag/Other为涉及的旗子，X/Y为涉及的地块
+type Violation struct {
+	Kind   ViolationKind
+	Flag   *Flag
+	Other  *Flag
+	X      int32
+	Y      int32
+	Detail string
+}
+
+func (v Violation) String() string {
+	s := fmt.Sprintf("%v at %d:%d", v.Kind, v.X, v.Y)
+	if v.Flag != nil {
+		s += fmt.Sprintf(" flag %d", v.Flag.ID)
+	}
+	if v.Other != nil {
+		s += fmt.Sprintf(" other %d", v.Other.ID)
+	}
+	if v.Detail != "" {
+		s += ": " + v.Detail
+	}
+	return s
+}
+
+// Validate 检查增量维护的各项状态是否互相一致，返回所有不一致之处
+func (m *Map) Validate() []Violation {
+	var violations []Violation
+	report := func(kind ViolationKind, f *Flag, other *Flag, x int32, y int32, detail string) {
+		violations = append(violations, Violation{kind, f, other, x, y, detail})
+	}
+
+	m.tiles.each(func(x int32, y int32, owner *Flag) {
+		if owner == nil {
+			report(ViolationEmptyTile, nil, nil, x, y, "")
+			return
+		}
+
+		if !m.hasFlag(owner) {
+			report(ViolationUnknownOwner, owner, nil, x, y, "")
+			return
+		}
+
+		if !owner.Bitmap.Test(x-owner.Tile.X, y-owner.Tile.Y) {
+			report(ViolationMissingBit, owner, nil, x, y, "")
+		}
+
+		if !owner.InArea(x, y) || m.isBlocked(x, y) {
+			report(ViolationOutOfArea, owner, nil, x, y, "")
+		}
+	})
+
+	flags := m.sortedFlags()
+	for _, f := range flags {
+		m.validateFlag(f, report)
+	}
+
+	reachable := make(map[*Flag]*Flag)
+	for _, f := range flags {
+		if f.IsAnchor() && reachable[f] == nil {
+			reachable[f] = f
+			queue := []*Flag{f}
+			for len(queue) > 0 {
+				cur := queue[0]
+				queue = queue[1:]
+				for neighbor := range cur.Neighbors {
+					if reachable[neighbor] == nil {
+						reachable[neighbor] = neighbor
+						queue = append(queue, neighbor)
+					}
+				}
+			}
+		}
+	}
+
+	for _, f := range flags {
+		if f.IsValid != (reachable[f] != nil) {
+			report(ViolationValidity, f, nil, f.Tile.X, f.Tile.Y, fmt.Sprintf("IsValid=%v", f.IsValid))
+		}
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+
+	return violations
+}
+
+func (m *Map) validateFlag(f *Flag, report func(ViolationKind, *Flag, *Flag, int32, int32, string)) {
+	if !f.Released && m.ownerAt(f.Tile.X, f.Tile.Y) != f {
+		report(ViolationFlagTile, f, nil, f.Tile.X, f.Tile.Y, "")
+	}
+
+	neighbors := make(map[*Flag]*Flag)
+	f.Bitmap.Each(func(dx int32, dy int32) {
+		x, y := f.Tile.X+dx, f.Tile.Y+dy
+		if m.ownerAt(x, y) != f {
+			report(ViolationStrayBit, f, nil, x, y, "")
+			return
+		}
+
+		for i := E; i <= N; i += 2 {
+			o := Orientations[i]
+			owner := m.ownerAt(x+o.X, y+o.Y)
+			if owner != nil && owner != f && owner.AllianceId == f.AllianceId {
+				neighbors[owner] = owner
+			}
+		}
+
+		code := m.vertexCodeAt(x, y)
+		if ok, got := f.IsVertex(x, y); got != code {
+			report(ViolationVertex, f, nil, x, y, fmt.Sprintf("got %d(%v), want %d", got, ok, code))
+		}
+	})
+
+	for x, row := range f.Vertexes {
+		for y := range row {
+			if !f.Bitmap.Test(x-f.Tile.X, y-f.Tile.Y) {
+				report(ViolationVertex, f, nil, x, y, "vertex outside territory")
+			}
+		}
+	}
+
+	for neighbor := range f.Neighbors {
+		if neighbor.Neighbors[f] != f {
+			report(ViolationAsymmetricNeighbor, f, neighbor, f.Tile.X, f.Tile.Y, "")
+		}
+		if neighbors[neighbor] == nil {
+			report(ViolationNeighbor, f, neighbor, f.Tile.X, f.Tile.Y, "linked but not adjacent")
+		}
+	}
+
+	for neighbor := range neighbors {
+		if f.Neighbors[neighbor] == nil {
+			report(ViolationNeighbor, f, neighbor, f.Tile.X, f.Tile.Y, "adjacent but not linked")
+		}
+	}
+
+	for overlap := range f.Overlaps {
+		if overlap.Overlaps[f] != f {
+			report(ViolationAsymmetricOverlap, f, overlap, f.Tile.X, f.Tile.Y, "")
+		}
+		if !m.hasFlag(overlap) {
+			report(ViolationUnknownOwner, f, overlap, f.Tile.X, f.Tile.Y, "overlap not on map")
+		}
+	}
+}
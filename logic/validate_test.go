@@ -0,0 +1,95 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+// validateWorld 联盟1的要塞和瞭望塔相邻，联盟2的要塞与瞭望塔重叠
+func validateWorld(t *testing.T) (m *Map, fortress *Flag, tower *Flag, enemy *Flag) {
+	m = NewMap()
+	add := func(x int32, y int32, allianceId int32, typeId int32, mtime int64) *Flag {
+		f, _, err := m.AddFlag(x, y, allianceId, typeId, time.Unix(mtime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	fortress = add(0, 0, 1, FlagTypeFortress, 0)
+	tower = add(14, 0, 1, FlagTypeWatchtower, 1)
+	enemy = add(26, 4, 2, FlagTypeFortress, 2)
+
+	if violations := m.Validate(); len(violations) > 0 {
+		t.Fatalf("clean map: %v", violations[0])
+	}
+	return m, fortress, tower, enemy
+}
+
+func hasViolation(violations []Violation, kind ViolationKind, f *Flag) bool {
+	for _, v := range violations {
+		if v.Kind == kind && v.Flag == f {
+			return true
+		}
+	}
+	return false
+}
+
+// 逐项破坏一致性，Validate应报告对应的问题
+func TestValidateReportsCorruption(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag)
+	}{
+		{
+			// 地块改归敌方但不更新位图
+			name: "tile owner",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				m.tiles.set(10, 0, enemy)
+				return ViolationMissingBit, enemy
+			},
+		},
+		{
+			name: "tile owner leaves a stray bit",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				m.tiles.set(10, 0, enemy)
+				return ViolationStrayBit, tower
+			},
+		},
+		{
+			name: "one-sided neighbor",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				delete(tower.Neighbors, fortress)
+				return ViolationAsymmetricNeighbor, fortress
+			},
+		},
+		{
+			name: "missing neighbor",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				delete(tower.Neighbors, fortress)
+				return ViolationNeighbor, tower
+			},
+		},
+		{
+			name: "bitmap bit",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				fortress.Bitmap.Clear(3, 3)
+				return ViolationMissingBit, fortress
+			},
+		},
+		{
+			name: "validity",
+			corrupt: func(m *Map, fortress *Flag, tower *Flag, enemy *Flag) (ViolationKind, *Flag) {
+				tower.IsValid = false
+				return ViolationValidity, tower
+			},
+		},
+	}
+
+	for _, c := range cases {
+		m, fortress, tower, enemy := validateWorld(t)
+		kind, f := c.corrupt(m, fortress, tower, enemy)
+		if violations := m.Validate(); !hasViolation(violations, kind, f) {
+			t.Errorf("%s: %v not reported for flag %d, got %v", c.name, kind, f.ID, violations)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package logic
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// minFlagsPerWorker 每个goroutine至少分到的旗子数，旗子较少时不值得启动goroutine
+const minFlagsPerWorker = 4
+
+// SetVertexWorkers 设置变更结束时并行重算顶点的goroutine数，不超过1时依次重算；默认为GOMAXPROCS
+func (m *Map) SetVertexWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	m.vertexWorkers = n
+}
+
+// calcVertexes 重算flags的顶点。每面旗子只写自己的Vertexes，读取的地块归属在此期间不会变化，
+// 因此可以分给多个goroutine，结果与依次重算一致
+func (m *Map) calcVertexes(flags []*Flag) {
+	workers := m.vertexWorkers
+	if limit := len(flags) / minFlagsPerWorker; workers > limit {
+		workers = limit
+	}
+
+	if workers <= 1 {
+		for _, f := range flags {
+			f.CalcVertexes()
+		}
+		return
+	}
+
+	next := int32(-1)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt32(&next, 1)); i < len(flags); i = int(atomic.AddInt32(&next, 1)) {
+				flags[i].CalcVertexes()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,168 @@
+package logic
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// vertexWorld 两个联盟交错放置的旗子，领地边界曲折，顶点较多
+func vertexWorld() (*Map, []*Flag) {
+	m := NewMap()
+	var flags []*Flag
+	for i := int32(0); i < 36; i++ {
+		x, y := 60+i%6*9, 60+i/6*9
+		typeId := int32(FlagTypeFortress)
+		if i%3 == 1 {
+			typeId = FlagTypeOutpost
+		}
+		if f, _, err := m.AddFlag(x, y, i%2+1, typeId, time.Unix(int64(i), 0)); err == nil {
+			flags = append(flags, f)
+		}
+	}
+	return m, flags
+}
+
+func TestVertexCodeMatchesSurround(t *testing.T) {
+	m, _ := vertexWorld()
+	for x := int32(50); x < 120; x++ {
+		for y := int32(50); y < 120; y++ {
+			var allianceId int32
+			if owner := m.ownerAt(x, y); owner != nil {
+				allianceId = owner.AllianceId
+			}
+
+			// 按各顶点类型的定义逐个判断
+			same := func(o *Orientation) bool {
+				owner := m.ownerAt(x+o.X, y+o.Y)
+				return owner != nil && owner.AllianceId == allianceId
+			}
+			want := 0
+			for subCode, vt := range VertexTypes {
+				o := vt.Orientation
+				if vt.IsOuter && !same(o.Back()) && !same(o.Left()) ||
+					!vt.IsOuter && same(o) && !same(o.rotate(-1)) && same(o.rotate(-2)) {
+					want |= subCode
+				}
+			}
+
+			if got := m.CalcVertexCode(&Tile{Vector2: Vector2{x, y}}); got != want {
+				t.Fatalf("%d:%d: code %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestCalcVertexCodeDoesNotAllocate(t *testing.T) {
+	m, flags := vertexWorld()
+	tile := flags[0].Tile
+	if n := testing.AllocsPerRun(100, func() { m.CalcVertexCode(tile) }); n != 0 {
+		t.Fatalf("CalcVertexCode allocates %v times", n)
+	}
+}
+
+// 领地不变时重算顶点复用原有的map，不分配内存
+func TestCalcVertexesDoesNotAllocate(t *testing.T) {
+	_, flags := vertexWorld()
+	for _, f := range flags {
+		if n := testing.AllocsPerRun(100, f.CalcVertexes); n != 0 {
+			t.Fatalf("flag %d: CalcVertexes allocates %v times", f.ID, n)
+		}
+	}
+}
+
+// 同样的变更分别以多个goroutine和依次重算顶点，每一步以及撤销后的状态都应完全一致
+func TestParallelVertexesMatchSequential(t *testing.T) {
+	parallel, sequential := NewMap(), NewMap()
+	for _, m := range []*Map{parallel, sequential} {
+		m.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	}
+	parallel.SetVertexWorkers(4)
+	sequential.SetVertexWorkers(1)
+
+	var pairs [][2]*Flag
+	rnd := rand.New(rand.NewSource(7))
+	for step := 0; step < 200; step++ {
+		if rnd.Intn(4) > 0 || len(pairs) == 0 {
+			x, y, allianceId := rnd.Int31n(60), rnd.Int31n(60), rnd.Int31n(3)+1
+			typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+			tm := time.Unix(int64(rnd.Intn(100)), 0)
+			a, _, errA := parallel.AddFlag(x, y, allianceId, typeId, tm)
+			b, _, errB := sequential.AddFlag(x, y, allianceId, typeId, tm)
+			if (errA == nil) != (errB == nil) {
+				t.Fatalf("step %d: AddFlag errors differ: %v, %v", step, errA, errB)
+			}
+			if errA == nil {
+				pairs = append(pairs, [2]*Flag{a, b})
+			}
+		} else {
+			i := rnd.Intn(len(pairs))
+			parallel.RemoveFlag(pairs[i][0])
+			sequential.RemoveFlag(pairs[i][1])
+			pairs = append(pairs[:i:i], pairs[i+1:]...)
+		}
+
+		if got, want := dumpState(parallel), dumpState(sequential); got != want {
+			t.Fatalf("step %d: parallel state differs:\n%s\nwant:\n%s", step, got, want)
+		}
+	}
+
+	for parallel.Undo() != nil {
+		sequential.Undo()
+		if got, want := dumpState(parallel), dumpState(sequential); got != want {
+			t.Fatalf("after undo: parallel state differs:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func BenchmarkCalcVertexCode(b *testing.B) {
+	m, flags := vertexWorld()
+	var tiles []Vector2
+	for _, f := range flags {
+		f.Bitmap.Each(func(dx int32, dy int32) {
+			tiles = append(tiles, Vector2{f.Tile.X + dx, f.Tile.Y + dy})
+		})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := tiles[i%len(tiles)]
+		m.vertexCodeAt(t.X, t.Y)
+	}
+}
+
+func BenchmarkCalcVertexes(b *testing.B) {
+	_, flags := vertexWorld()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		flags[i%len(flags)].CalcVertexes()
+	}
+}
+
+// benchmarkDenseAdd 在已有大量旗子的区域中放置再移除一面旗子，重算的顶点涉及几十面相邻的旗子
+func benchmarkDenseAdd(b *testing.B, workers int) {
+	m, _ := vertexWorld()
+	m.SetJournalLimit(0)
+	m.SetVertexWorkers(workers)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, _, err := m.AddFlag(84, 84, 1, FlagTypeWatchtower, time.Unix(0, 0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.RemoveFlag(f)
+	}
+}
+
+func BenchmarkDenseAddSequential(b *testing.B) {
+	benchmarkDenseAdd(b, 1)
+}
+
+func BenchmarkDenseAddParallel(b *testing.B) {
+	benchmarkDenseAdd(b, 4)
+}
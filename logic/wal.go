@@ -0,0 +1,523 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultCompactEvery 默认每写入这么多条日志就合并为一次快照
+const DefaultCompactEvery = 4096
+
+const (
+	walFileName      = "wal"
+	snapshotFileName = "snapshot"
+	walHeaderSize    = 12
+	walMaxRecordSize = 1 << 30
+)
+
+var ErrBadRecord = errors.New("bad log record")
+
+// ErrLogBroken 写入失败后无法截掉写了一半的记录，日志不能再写入
+var ErrLogBroken = errors.New("write-ahead log is unusable")
+
+type walKind byte
+
+const (
+	walAddFlag walKind = iota + 1
+	walRemoveFlag
+	walSetTerrain
+	walTick
+	walSetResolver
+	walSetPolicy
+)
+
+// walRecord 日志中的一次操作；now是操作时的时钟，重放时旗子的失效时间与原来一致
+type walRecord struct {
+	seq        uint64
+	kind       walKind
+	now        time.Time
+	x          int32
+	y          int32
+	allianceId int32
+	typeId     int32
+	flagId     int32
+	mtime      time.Time
+	terrain    Terrain
+	name       string
+	policy     InvalidPolicy
+	grace      time.Duration
+}
+
+func (rec *walRecord) encode() []byte {
+	w := &snapshotWriter{}
+	w.uvarint(rec.seq)
+	w.buf.WriteByte(byte(rec.kind))
+	w.time(rec.now)
+
+	switch rec.kind {
+	case walAddFlag:
+		w.varint(int64(rec.x))
+		w.varint(int64(rec.y))
+		w.varint(int64(rec.allianceId))
+		w.varint(int64(rec.typeId))
+		w.time(rec.mtime)
+	case walRemoveFlag:
+		w.varint(int64(rec.flagId))
+	case walSetTerrain:
+		w.varint(int64(rec.x))
+		w.varint(int64(rec.y))
+		w.buf.WriteByte(byte(rec.terrain))
+	case walTick:
+		w.time(rec.mtime)
+	case walSetResolver:
+		w.uvarint(uint64(len(rec.name)))
+		w.buf.WriteString(rec.name)
+	case walSetPolicy:
+		w.varint(int64(rec.policy))
+		w.varint(int64(rec.grace))
+	}
+
+	return w.buf.Bytes()
+}
+
+func (rec *walRecord) decode(data []byte) error {
+	r := &snapshotReader{r: bytes.NewReader(data)}
+	rec.seq = r.uvarint()
+	rec.kind = walKind(r.byte())
+	rec.now = r.time()
+
+	switch rec.kind {
+	case walAddFlag:
+		rec.x = r.int32()
+		rec.y = r.int32()
+		rec.allianceId = r.int32()
+		rec.typeId = r.int32()
+		rec.mtime = r.time()
+	case walRemoveFlag:
+		rec.flagId = r.int32()
+	case walSetTerrain:
+		rec.x = r.int32()
+		rec.y = r.int32()
+		rec.terrain = Terrain(r.byte())
+	case walTick:
+		rec.mtime = r.time()
+	case walSetResolver:
+		rec.name = string(r.bytes(r.count()))
+	case walSetPolicy:
+		rec.policy = InvalidPolicy(r.varint())
+		rec.grace = time.Duration(r.varint())
+	default:
+		if r.err == nil {
+			return fmt.Errorf("%w: unknown kind %d", ErrBadRecord, rec.kind)
+		}
+	}
+
+	return r.err
+}
+
+// writeFrame 写入一帧：4字节长度、4字节内容的CRC32、4字节前8字节的CRC32，之后是内容
+func writeFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(frame[8:], crc32.ChecksumIEEE(frame[:8]))
+	copy(frame[walHeaderSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame 读取一帧，正好读到结尾时返回io.EOF，不完整或校验失败时返回ErrBadRecord。
+// torn表示文件在这一帧中间结束，即写入时崩溃留下的残帧；头部校验失败时长度不可信，不会视为残帧。
+// 内容校验失败时仍返回读到的内容，调用者据此判断这一帧是否在结尾
+func readFrame(r io.Reader) (payload []byte, torn bool, err error) {
+	header := make([]byte, walHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, false, io.EOF
+		}
+		return nil, n > 0, fmt.Errorf("%w: %v", ErrBadRecord, err)
+	}
+
+	if crc32.ChecksumIEEE(header[:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return nil, false, fmt.Errorf("%w: header checksum mismatch", ErrBadRecord)
+	}
+
+	size := binary.LittleEndian.Uint32(header)
+	if size > walMaxRecordSize {
+		return nil, false, fmt.Errorf("%w: size %d", ErrBadRecord, size)
+	}
+
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, true, fmt.Errorf("%w: %v", ErrBadRecord, err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return payload, false, fmt.Errorf("%w: checksum mismatch", ErrBadRecord)
+	}
+
+	return payload, false, nil
+}
+
+// walFile 日志文件，测试中替换为会出错的实现
+type walFile interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// DurableMap 每次变更先写入本地日志再执行，重启时读取最近的快照并重放之后的日志
+type DurableMap struct {
+	m            *Map
+	dir          string
+	wal          walFile
+	offset       int64  //最后一条完整记录的结尾
+	broken       error  //非nil时拒绝写入
+	seq          uint64 //最后一条日志的序号
+	records      int    //上次合并后写入的日志数
+	compactEvery int
+	compactErr   error //最近一次自动合并的错误
+	clock        func() time.Time
+	now          time.Time
+}
+
+// OpenDurableMap 打开或创建dir下的地图；日志最后一条记录不完整或校验失败时视为写入时崩溃，会被截掉，
+// 中间的记录或任何记录的头部损坏时返回ErrBadRecord
+func OpenDurableMap(dir string) (*DurableMap, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &DurableMap{
+		dir:          dir,
+		compactEvery: DefaultCompactEvery,
+		clock:        time.Now,
+	}
+
+	m, err := d.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	d.m = m
+	m.SetClock(func() time.Time { return d.now })
+	// 撤销不经过日志，重启后无法恢复
+	m.SetJournalLimit(0)
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.wal = wal
+
+	if err := d.replay(); err != nil {
+		d.wal.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *DurableMap) loadSnapshot() (*Map, error) {
+	file, err := os.Open(filepath.Join(d.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return NewMap(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	payload, _, err := readFrame(file)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, ErrBadSnapshot
+	}
+
+	s := &Snapshot{}
+	if err := s.UnmarshalBinary(payload[n:]); err != nil {
+		return nil, err
+	}
+
+	d.seq = seq
+	return NewMapFromSnapshot(s, true)
+}
+
+// replay 重放快照之后的日志，合并时在替换快照后、清空日志前崩溃会留下已合并的记录，按序号跳过
+func (d *DurableMap) replay() error {
+	size, err := d.wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var offset int64
+	r := bufio.NewReader(d.wal)
+	for {
+		payload, torn, err := readFrame(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 最后一帧内容校验失败同样是写入时崩溃；其他情况是文件损坏，不能丢弃之后已确认的记录
+			if !torn && (payload == nil || offset+walHeaderSize+int64(len(payload)) < size) {
+				return fmt.Errorf("record at %d: %w", offset, err)
+			}
+
+			// 写入时崩溃留下的残缺记录，丢弃
+			if err := d.wal.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		rec := &walRecord{}
+		if err := rec.decode(payload); err != nil {
+			return fmt.Errorf("record at %d: %w", offset, err)
+		}
+		offset += int64(walHeaderSize + len(payload))
+
+		if rec.seq <= d.seq {
+			continue
+		}
+
+		d.seq = rec.seq
+		d.records++
+		d.apply(rec)
+	}
+
+	d.offset = offset
+	_, err = d.wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+// apply 执行一条记录，结果与写入日志时一致
+func (d *DurableMap) apply(rec *walRecord) (*Flag, *ChangeSet, error) {
+	d.now = rec.now
+
+	switch rec.kind {
+	case walAddFlag:
+		return d.m.AddFlag(rec.x, rec.y, rec.allianceId, rec.typeId, rec.mtime)
+	case walRemoveFlag:
+		flag := d.m.flagById(rec.flagId)
+		if flag == nil {
+			return nil, nil, ErrNotOnMap
+		}
+		return nil, d.m.RemoveFlag(flag), nil
+	case walSetTerrain:
+		return nil, nil, d.m.SetTerrain(rec.x, rec.y, rec.terrain)
+	case walTick:
+		return nil, d.m.Tick(rec.mtime), nil
+	case walSetResolver:
+		d.m.SetConflictResolver(presetByName(rec.name))
+	case walSetPolicy:
+		d.m.SetInvalidPolicy(rec.policy, rec.grace)
+	}
+
+	return nil, nil, nil
+}
+
+// log 写入并刷到磁盘后执行
+func (d *DurableMap) log(rec *walRecord) (*Flag, *ChangeSet, error) {
+	if d.broken != nil {
+		return nil, nil, d.broken
+	}
+
+	rec.seq = d.seq + 1
+	rec.now = d.clock()
+
+	if err := d.append(rec.encode()); err != nil {
+		return nil, nil, err
+	}
+
+	d.seq = rec.seq
+	d.records++
+	f, cs, err := d.apply(rec)
+
+	// 记录已经生效，合并失败不能当作这次变更失败，之后每次写入都会重试
+	if d.compactEvery > 0 && d.records >= d.compactEvery {
+		d.compactErr = d.Compact()
+	}
+
+	return f, cs, err
+}
+
+// CompactError 返回最近一次自动合并的错误，成功时为nil；合并失败不影响已写入的记录
+func (d *DurableMap) CompactError() error {
+	return d.compactErr
+}
+
+// append 写入一帧并刷到磁盘。失败时截掉可能写了一半的帧，否则之后的记录会接在残帧后面，重启时被当作残缺的结尾丢弃；
+// 截不掉时日志不再可用
+func (d *DurableMap) append(payload []byte) error {
+	err := writeFrame(d.wal, payload)
+	if err == nil {
+		err = d.wal.Sync()
+	}
+	if err == nil {
+		d.offset += int64(walHeaderSize + len(payload))
+		return nil
+	}
+
+	if rewindErr := d.rewind(); rewindErr != nil {
+		d.broken = fmt.Errorf("%w: %v", ErrLogBroken, rewindErr)
+	}
+	return err
+}
+
+// rewind 把日志截回最后一条完整记录的结尾
+func (d *DurableMap) rewind() error {
+	if err := d.wal.Truncate(d.offset); err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(d.offset, io.SeekStart); err != nil {
+		return err
+	}
+	return d.wal.Sync()
+}
+
+// Map 返回底层地图用于查询，直接在其上修改不会写入日志
+func (d *DurableMap) Map() *Map {
+	return d.m
+}
+
+// SetClock 设置记录到日志中的时钟
+func (d *DurableMap) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	d.clock = clock
+}
+
+// SetCompactEvery 设置写入多少条日志后自动合并，0表示只能手动调用Compact
+func (d *DurableMap) SetCompactEvery(records int) {
+	d.compactEvery = records
+}
+
+// AddFlag 不能放置时不写日志
+func (d *DurableMap) AddFlag(x int32, y int32, allianceId int32, typeId int32, tm time.Time) (*Flag, *ChangeSet, error) {
+	if err := d.m.CanPlaceFlag(x, y, allianceId, typeId); err != nil {
+		return nil, nil, err
+	}
+
+	return d.log(&walRecord{kind: walAddFlag, x: x, y: y, allianceId: allianceId, typeId: typeId, mtime: tm})
+}
+
+func (d *DurableMap) RemoveFlag(flag *Flag) (*ChangeSet, error) {
+	if !d.m.hasFlag(flag) {
+		return nil, ErrNotOnMap
+	}
+
+	_, cs, err := d.log(&walRecord{kind: walRemoveFlag, flagId: flag.ID})
+	return cs, err
+}
+
+// SetTerrain 不能设置时不写日志
+func (d *DurableMap) SetTerrain(x int32, y int32, terrain Terrain) error {
+	if err := d.m.checkTerrain(x, y, terrain); err != nil {
+		return err
+	}
+
+	_, _, err := d.log(&walRecord{kind: walSetTerrain, x: x, y: y, terrain: terrain})
+	return err
+}
+
+func (d *DurableMap) Tick(now time.Time) (*ChangeSet, error) {
+	_, cs, err := d.log(&walRecord{kind: walTick, mtime: now})
+	return cs, err
+}
+
+// SetConflictResolver 只能使用内置策略，自定义策略无法写入日志
+func (d *DurableMap) SetConflictResolver(resolver ConflictResolver) error {
+	preset, ok := resolver.(*presetResolver)
+	if !ok {
+		return errors.New("only preset resolvers can be logged")
+	}
+
+	_, _, err := d.log(&walRecord{kind: walSetResolver, name: preset.name})
+	return err
+}
+
+func (d *DurableMap) SetInvalidPolicy(policy InvalidPolicy, gracePeriod time.Duration) error {
+	_, _, err := d.log(&walRecord{kind: walSetPolicy, policy: policy, grace: gracePeriod})
+	return err
+}
+
+// Compact 把当前地图写成新快照并清空日志；快照先写入临时文件再替换，任何时刻崩溃都能恢复
+func (d *DurableMap) Compact() error {
+	data, err := d.m.Snapshot(true).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	w := &snapshotWriter{}
+	w.uvarint(d.seq)
+	w.buf.Write(data)
+
+	path := filepath.Join(d.dir, snapshotFileName)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = writeFrame(tmp, w.buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if dir, err := os.Open(d.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// 快照已包含日志中的所有记录，清空失败时重启也会按序号跳过它们
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(0, io.SeekStart); err != nil {
+		d.broken = fmt.Errorf("%w: %v", ErrLogBroken, err)
+		return err
+	}
+	d.offset = 0
+	d.records = 0
+	return d.wal.Sync()
+}
+
+func (d *DurableMap) Close() error {
+	return d.wal.Close()
+}
+
+func (m *Map) flagById(id int32) *Flag {
+	for _, flags := range m.flags {
+		for f := range flags {
+			if f.ID == id {
+				return f
+			}
+		}
+	}
+	return nil
+}
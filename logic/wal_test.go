@@ -0,0 +1,353 @@
+package logic
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// durableSteps 在DurableMap上随机执行n次变更
+func durableSteps(t *testing.T, rnd *rand.Rand, d *DurableMap, n int) {
+	for i := 0; i < n; i++ {
+		var err error
+		switch k := rnd.Intn(10); {
+		case k < 6:
+			typeId := flagTypeIds[rnd.Intn(len(flagTypeIds))]
+			_, _, err = d.AddFlag(rnd.Int31n(40), rnd.Int31n(40), rnd.Int31n(3)+1, typeId, time.Unix(int64(rnd.Intn(50)), 0))
+		case k < 8:
+			if flags := d.Map().sortedFlags(); len(flags) > 0 {
+				_, err = d.RemoveFlag(flags[rnd.Intn(len(flags))])
+			}
+		case k < 9:
+			err = d.SetTerrain(rnd.Int31n(40), rnd.Int31n(40), Terrain(rnd.Intn(int(TerrainHill)+1)))
+		default:
+			_, err = d.Tick(time.Unix(int64(1000+rnd.Intn(100)), 0))
+		}
+
+		if err != nil {
+			if _, ok := err.(*PlacementError); !ok && err != ErrOccupied {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func openDurable(t *testing.T, dir string) *DurableMap {
+	d, err := OpenDurableMap(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetClock(func() time.Time { return time.Unix(1000, 0) })
+	return d
+}
+
+func TestDurableMapRecovers(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		dir := t.TempDir()
+
+		d := openDurable(t, dir)
+		d.SetCompactEvery(0)
+		if err := d.SetInvalidPolicy(InvalidRelease, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		durableSteps(t, rnd, d, 30)
+		if err := d.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetConflictResolver(ResolveNearest); err != nil {
+			t.Fatal(err)
+		}
+		durableSteps(t, rnd, d, 30)
+		want := dumpState(d.Map())
+		d.Close()
+
+		d = openDurable(t, dir)
+		if got := dumpState(d.Map()); got != want {
+			t.Fatalf("seed %d: recovered:\n%s\nwant:\n%s", seed, got, want)
+		}
+		if violations := d.Map().Validate(); len(violations) > 0 {
+			t.Fatalf("seed %d: %v", seed, violations[0])
+		}
+		d.Close()
+	}
+}
+
+func TestDurableMapTornTail(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	dir := t.TempDir()
+	wal := filepath.Join(dir, walFileName)
+
+	d := openDurable(t, dir)
+	durableSteps(t, rnd, d, 20)
+	want := dumpState(d.Map())
+	info, _ := os.Stat(wal)
+	size := info.Size()
+	durableSteps(t, rnd, d, 1)
+	for info, _ = os.Stat(wal); info.Size() == size; info, _ = os.Stat(wal) {
+		durableSteps(t, rnd, d, 1)
+	}
+	d.Close()
+
+	// 最后一条记录只写了一半
+	if err := os.Truncate(wal, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openDurable(t, dir)
+	if got := dumpState(d.Map()); got != want {
+		t.Fatalf("after torn write:\n%s\nwant:\n%s", got, want)
+	}
+
+	// 截掉残缺记录后可以继续写入
+	durableSteps(t, rnd, d, 10)
+	want = dumpState(d.Map())
+	d.Close()
+
+	d = openDurable(t, dir)
+	defer d.Close()
+	if got := dumpState(d.Map()); got != want {
+		t.Fatalf("after appending past a torn write:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDurableMapCompactionCrash(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	dir := t.TempDir()
+	wal := filepath.Join(dir, walFileName)
+
+	d := openDurable(t, dir)
+	d.SetCompactEvery(0)
+	durableSteps(t, rnd, d, 30)
+	log, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	want := dumpState(d.Map())
+	d.Close()
+
+	// 快照已替换但日志还未清空
+	if err := os.WriteFile(wal, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openDurable(t, dir)
+	defer d.Close()
+	if got := dumpState(d.Map()); got != want {
+		t.Fatalf("after crash during compaction:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDurableMapAutoCompact(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	dir := t.TempDir()
+
+	d := openDurable(t, dir)
+	d.SetCompactEvery(5)
+	durableSteps(t, rnd, d, 40)
+	want := dumpState(d.Map())
+	d.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openDurable(t, dir)
+	defer d.Close()
+	if got := dumpState(d.Map()); got != want {
+		t.Fatalf("recovered:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// failingWal 按设定让下一次写入只写一半后失败，或让下一次刷盘失败
+type failingWal struct {
+	walFile
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingWal) Write(p []byte) (int, error) {
+	if f.failWrite {
+		f.failWrite = false
+		n, _ := f.walFile.Write(p[:len(p)/2])
+		return n, errors.New("disk full")
+	}
+	return f.walFile.Write(p)
+}
+
+func (f *failingWal) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errors.New("sync failed")
+	}
+	return f.walFile.Sync()
+}
+
+// 写入失败的记录不能影响之后写入的记录
+func TestDurableMapFailedWrite(t *testing.T) {
+	for _, mode := range []string{"write", "sync"} {
+		rnd := rand.New(rand.NewSource(4))
+		dir := t.TempDir()
+
+		d := openDurable(t, dir)
+		d.SetCompactEvery(0)
+		durableSteps(t, rnd, d, 10)
+
+		d.wal = &failingWal{walFile: d.wal, failWrite: mode == "write", failSync: mode == "sync"}
+		before := dumpState(d.Map())
+		if _, _, err := d.AddFlag(100, 100, 1, FlagTypeFortress, time.Unix(0, 0)); err == nil {
+			t.Fatalf("%s: AddFlag succeeded on a failing log", mode)
+		}
+		if dumpState(d.Map()) != before {
+			t.Fatalf("%s: failed record was applied", mode)
+		}
+
+		durableSteps(t, rnd, d, 10)
+		want := dumpState(d.Map())
+		d.Close()
+
+		d = openDurable(t, dir)
+		if got := dumpState(d.Map()); got != want {
+			t.Fatalf("%s: recovered:\n%s\nwant:\n%s", mode, got, want)
+		}
+		d.Close()
+	}
+}
+
+// brokenTruncate 截断也失败
+type brokenTruncate struct {
+	failingWal
+}
+
+func (f *brokenTruncate) Truncate(size int64) error {
+	return errors.New("truncate failed")
+}
+
+func TestDurableMapRefusesWritesAfterFailedRewind(t *testing.T) {
+	d := openDurable(t, t.TempDir())
+	defer d.Close()
+
+	d.wal = &brokenTruncate{failingWal{walFile: d.wal, failWrite: true}}
+	if _, _, err := d.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0)); err == nil {
+		t.Fatal("AddFlag succeeded on a failing log")
+	}
+	if _, err := d.Tick(time.Unix(1, 0)); !errors.Is(err, ErrLogBroken) {
+		t.Fatalf("Tick after failed rewind = %v, want ErrLogBroken", err)
+	}
+}
+
+// 中间的记录损坏不是写入时崩溃，不能把之后的记录一起截掉
+func TestDurableMapCorruptMiddleRecord(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	dir := t.TempDir()
+	wal := filepath.Join(dir, walFileName)
+
+	d := openDurable(t, dir)
+	d.SetCompactEvery(0)
+	durableSteps(t, rnd, d, 10)
+	d.Close()
+
+	data, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[walHeaderSize] ^= 0xff
+	if err := os.WriteFile(wal, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDurableMap(dir); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("OpenDurableMap = %v, want ErrBadRecord", err)
+	}
+	if info, _ := os.Stat(wal); info.Size() != int64(len(data)) {
+		t.Fatalf("log truncated to %d bytes", info.Size())
+	}
+}
+
+// 长度损坏时按错误的长度读取会像是文件在帧中间结束，不能当作残帧截掉整个日志
+func TestDurableMapCorruptLength(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	dir := t.TempDir()
+	wal := filepath.Join(dir, walFileName)
+
+	d := openDurable(t, dir)
+	d.SetCompactEvery(0)
+	durableSteps(t, rnd, d, 10)
+	d.Close()
+
+	data, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[1] ^= 0x01
+	if err := os.WriteFile(wal, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDurableMap(dir); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("OpenDurableMap = %v, want ErrBadRecord", err)
+	}
+	if info, _ := os.Stat(wal); info.Size() != int64(len(data)) {
+		t.Fatalf("log truncated to %d bytes", info.Size())
+	}
+}
+
+// 自动合并失败时变更本身已经生效，不能返回错误让调用者重试
+func TestDurableMapFailedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	d.SetCompactEvery(1)
+
+	d.dir = filepath.Join(dir, "missing")
+	f, _, err := d.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0))
+	if err != nil || f == nil {
+		t.Fatalf("AddFlag = %v, %v", f, err)
+	}
+	if d.CompactError() == nil {
+		t.Fatal("failed compaction not reported")
+	}
+
+	d.dir = dir
+	if _, _, err := d.AddFlag(40, 0, 1, FlagTypeFortress, time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompactError(); err != nil {
+		t.Fatalf("compaction still failing: %v", err)
+	}
+	want := dumpState(d.Map())
+	d.Close()
+
+	d = openDurable(t, dir)
+	defer d.Close()
+	if got := dumpState(d.Map()); got != want {
+		t.Fatalf("recovered:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDurableMapRejectsInvalidTerrain(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurable(t, dir)
+	if _, _, err := d.AddFlag(0, 0, 1, FlagTypeFortress, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTerrain(0, 0, TerrainWater); err != ErrOccupied {
+		t.Fatalf("SetTerrain on a flag = %v, want ErrOccupied", err)
+	}
+	if err := d.SetTerrain(1, 1, Terrain(200)); err != ErrUnknownTerrain {
+		t.Fatalf("SetTerrain unknown = %v, want ErrUnknownTerrain", err)
+	}
+	seq := d.seq
+	d.Close()
+
+	d = openDurable(t, dir)
+	defer d.Close()
+	if d.seq != seq || d.records != 1 {
+		t.Fatalf("rejected terrain changes were logged: %d records", d.records)
+	}
+}
@@ -99,8 +99,11 @@ func main() {
 	flags := make([]*logic.Flag, 0, len(points))
 
 	for i, point := range points {
-		x, y, allianceId, fortress := point[1], point[2], point[0], point[3] == 1
-		f, err := m.AddFlag(x, y, allianceId, fortress, time.Now().Add(time.Second*time.Duration(i)))
+		x, y, allianceId, flagType := point[1], point[2], point[0], int32(logic.FlagTypeWatchtower)
+		if point[3] == 1 {
+			flagType = logic.FlagTypeFortress
+		}
+		f, _, err := m.AddFlag(x, y, allianceId, flagType, time.Now().Add(time.Second*time.Duration(i)))
 		if err != nil {
 			fmt.Printf("%d,%d,%v\n", x, y, err)
 		} else {